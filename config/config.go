@@ -18,10 +18,40 @@ type Config struct {
 	DbUser       string `toml:"db_user"`
 	DbPassword   string `toml:"db_pass"`
 	DbSlaveID    uint32 `toml:"db_slave_id"`
+	GTIDMode     bool   `toml:"gtid_mode"`
+	DbTLS        bool   `toml:"db_tls"`
+	DbTLSCaCert  string `toml:"db_tls_ca_cert"`
+	DbTLSClientCert string `toml:"db_tls_client_cert"`
+	DbTLSClientKey string `toml:"db_tls_client_key"`
+	DbTLSServerName string `toml:"db_tls_server_name"`
+	DbTLSInsecureSkipVerify bool `toml:"db_tls_insecure_skip_verify"`
+	DbWatermarkTable string `toml:"db_watermark_table"`
+	DbHeartbeatTable string `toml:"db_heartbeat_table"`
+	HeartbeatInterval int `toml:"heartbeat_interval"`
+	DbTimeZone   string `toml:"db_time_zone"`
+	TimePrecision int   `toml:"time_precision"`
+	ZeroDate     string `toml:"zero_date"`
 	EsHost       string `toml:"es_host"`
+	EsScheme     string `toml:"es_scheme"`
+	EsUser       string `toml:"es_user"`
+	EsPassword   string `toml:"es_pass"`
+	EsPasswordFile string `toml:"es_pass_file"`
+	EsApiKey     string `toml:"es_api_key"`
+	EsCaCert     string `toml:"es_ca_cert"`
+	EsClientCert string `toml:"es_client_cert"`
+	EsClientKey  string `toml:"es_client_key"`
+	EsInsecureSkipVerify bool `toml:"es_insecure_skip_verify"`
 	EsMaxActions int    `toml:"es_max_actions"`
 	EsMaxBytes   int64  `toml:"es_max_bytes"`
+	EsMaxRetries int    `toml:"es_max_retries"`
+	DeadLetterFile string `toml:"dead_letter_file"`
+	EsWorkers    int    `toml:"es_workers"`
+	EsQueueSize  int    `toml:"es_queue_size"`
+	EsFlushInterval int `toml:"es_flush_interval"`
 	DumpExec     string `toml:"dump_exec"`
+	DumpChunkSize int   `toml:"dump_chunk_size"`
+	StatAddr     string `toml:"stat_addr"`
+	ControlToken string `toml:"control_token"`
 	Sources      []SourceConfig `toml:"source"`
 	Rules        []*Rule `toml:"rule"`
 }
@@ -38,10 +68,40 @@ var Default = Config {
 	"root",
 	"",
 	1001,
+	false,
+	false,
+	"",
+	"",
+	"",
+	"",
+	false,
+	"",
+	"",
+	1,
+	"UTC",
+	-1,
+	ZeroDateNull,
 	"127.0.0.1:9200",
+	"http",
+	"",
+	"",
+	"",
+	"",
+	"",
+	"",
+	"",
+	false,
 	0,
 	99 * 1024 * 1024,
+	15,
+	"",
+	4,
+	2,
+	1,
 	"mydumper",
+	1000,
+	"",
+	"",
 	[]SourceConfig{},
 	[]*Rule{},
 }
@@ -1,8 +1,10 @@
 package config
 
 import (
+	"strings"
 	"testing"
 
+	"github.com/ehalpern/go-mysql/schema"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -14,9 +16,39 @@ func TestDefaults(t *testing.T) {
 	assert.Equal(t, Default.DbUser, c.DbUser)
 	assert.Equal(t, Default.DbPassword, c.DbPassword)
 	assert.Equal(t, Default.DbSlaveID, c.DbSlaveID)
+	assert.Equal(t, Default.GTIDMode, c.GTIDMode)
+	assert.False(t, c.DbTLS)
+	assert.Equal(t, Default.DbTLSCaCert, c.DbTLSCaCert)
+	assert.Equal(t, Default.DbTLSClientCert, c.DbTLSClientCert)
+	assert.Equal(t, Default.DbTLSClientKey, c.DbTLSClientKey)
+	assert.Equal(t, Default.DbTLSServerName, c.DbTLSServerName)
+	assert.False(t, c.DbTLSInsecureSkipVerify)
+	assert.Equal(t, Default.DbWatermarkTable, c.DbWatermarkTable)
+	assert.Equal(t, Default.DbHeartbeatTable, c.DbHeartbeatTable)
+	assert.Equal(t, Default.HeartbeatInterval, c.HeartbeatInterval)
+	assert.Equal(t, "UTC", c.DbTimeZone)
+	assert.Equal(t, -1, c.TimePrecision)
+	assert.Equal(t, ZeroDateNull, c.ZeroDate)
 	assert.Equal(t, Default.EsHost, c.EsHost)
+	assert.Equal(t, "http", c.EsScheme)
+	assert.Equal(t, Default.EsUser, c.EsUser)
+	assert.Equal(t, Default.EsPassword, c.EsPassword)
+	assert.Equal(t, Default.EsPasswordFile, c.EsPasswordFile)
+	assert.Equal(t, Default.EsApiKey, c.EsApiKey)
+	assert.Equal(t, Default.EsCaCert, c.EsCaCert)
+	assert.Equal(t, Default.EsClientCert, c.EsClientCert)
+	assert.Equal(t, Default.EsClientKey, c.EsClientKey)
+	assert.False(t, c.EsInsecureSkipVerify)
 	assert.Equal(t, Default.EsMaxActions, c.EsMaxActions)
 	assert.Equal(t, Default.EsMaxBytes, c.EsMaxBytes)
+	assert.Equal(t, 15, c.EsMaxRetries)
+	assert.Equal(t, Default.DeadLetterFile, c.DeadLetterFile)
+	assert.Equal(t, 4, c.EsWorkers)
+	assert.Equal(t, 2, c.EsQueueSize)
+	assert.Equal(t, 1, c.EsFlushInterval)
+	assert.Equal(t, 1000, c.DumpChunkSize)
+	assert.Equal(t, Default.StatAddr, c.StatAddr)
+	assert.Equal(t, "", c.ControlToken)
 }
 
 func TestOverrides(t *testing.T) {
@@ -26,9 +58,39 @@ db_host = "db.test.com:3306"
 db_user = "user1"
 db_pass = "password1"
 db_slave_id = 4
+gtid_mode = true
+db_tls = true
+db_tls_ca_cert = "./var/test/mysql-ca.pem"
+db_tls_client_cert = "./var/test/mysql-client.pem"
+db_tls_client_key = "./var/test/mysql-client.key"
+db_tls_server_name = "db.test.com"
+db_tls_insecure_skip_verify = true
+db_watermark_table = "meta.watermark"
+db_heartbeat_table = "meta.heartbeat"
+heartbeat_interval = 5
+db_time_zone = "America/New_York"
+time_precision = 3
+zero_date = "epoch"
 es_host = "es.test.com:9200"
+es_scheme = "https"
+es_user = "elastic"
+es_pass = "password2"
+es_pass_file = "./var/test/es_pass"
+es_api_key = "a2V5OnNlY3JldA=="
+es_ca_cert = "./var/test/ca.pem"
+es_client_cert = "./var/test/client.pem"
+es_client_key = "./var/test/client.key"
+es_insecure_skip_verify = true
 es_max_actions = 50
 es_max_bytes = 5000000
+es_max_retries = 3
+dead_letter_file = "./var/test/rejected.json"
+es_workers = 8
+es_queue_size = 1
+es_flush_interval = 5
+dump_chunk_size = 500
+stat_addr = "127.0.0.1:12800"
+control_token = "secret"
 `)
 	assert.Nil(t, err)
 	assert.Equal(t, "./var/test", c.DataDir)
@@ -36,9 +98,67 @@ es_max_bytes = 5000000
 	assert.Equal(t, "user1", c.DbUser)
 	assert.Equal(t, "password1", c.DbPassword)
 	assert.Equal(t, uint32(4), c.DbSlaveID)
+	assert.True(t, c.GTIDMode)
+	assert.True(t, c.DbTLS)
+	assert.Equal(t, "./var/test/mysql-ca.pem", c.DbTLSCaCert)
+	assert.Equal(t, "./var/test/mysql-client.pem", c.DbTLSClientCert)
+	assert.Equal(t, "./var/test/mysql-client.key", c.DbTLSClientKey)
+	assert.Equal(t, "db.test.com", c.DbTLSServerName)
+	assert.True(t, c.DbTLSInsecureSkipVerify)
+	assert.Equal(t, "meta.watermark", c.DbWatermarkTable)
+	assert.Equal(t, "meta.heartbeat", c.DbHeartbeatTable)
+	assert.Equal(t, 5, c.HeartbeatInterval)
+	assert.Equal(t, "America/New_York", c.DbTimeZone)
+	assert.Equal(t, 3, c.TimePrecision)
+	assert.Equal(t, ZeroDateEpoch, c.ZeroDate)
 	assert.Equal(t, "es.test.com:9200", c.EsHost)
+	assert.Equal(t, "https", c.EsScheme)
+	assert.Equal(t, "elastic", c.EsUser)
+	assert.Equal(t, "password2", c.EsPassword)
+	assert.Equal(t, "./var/test/es_pass", c.EsPasswordFile)
+	assert.Equal(t, "a2V5OnNlY3JldA==", c.EsApiKey)
+	assert.Equal(t, "./var/test/ca.pem", c.EsCaCert)
+	assert.Equal(t, "./var/test/client.pem", c.EsClientCert)
+	assert.Equal(t, "./var/test/client.key", c.EsClientKey)
+	assert.True(t, c.EsInsecureSkipVerify)
 	assert.Equal(t, 50, c.EsMaxActions)
 	assert.Equal(t, int64(5000000), c.EsMaxBytes)
+	assert.Equal(t, 3, c.EsMaxRetries)
+	assert.Equal(t, "./var/test/rejected.json", c.DeadLetterFile)
+	assert.Equal(t, 8, c.EsWorkers)
+	assert.Equal(t, 1, c.EsQueueSize)
+	assert.Equal(t, 5, c.EsFlushInterval)
+	assert.Equal(t, 500, c.DumpChunkSize)
+	assert.Equal(t, "127.0.0.1:12800", c.StatAddr)
+	assert.Equal(t, "secret", c.ControlToken)
+}
+
+func TestTimeConversion(t *testing.T) {
+	c := Default
+	tc, err := c.TimeConversion()
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultTimeConversion, tc)
+
+	c.DbTimeZone = "America/New_York"
+	c.TimePrecision = 3
+	c.ZeroDate = ZeroDateKeep
+	tc, err = c.TimeConversion()
+	assert.Nil(t, err)
+	assert.Equal(t, "America/New_York", tc.Location.String())
+	assert.Equal(t, 3, tc.Precision)
+	assert.Equal(t, ZeroDateKeep, tc.ZeroDate)
+
+	c.DbTimeZone = "Nowhere/Atlantis"
+	_, err = c.TimeConversion()
+	assert.NotNil(t, err)
+	c.DbTimeZone = "UTC"
+	c.TimePrecision = 7
+	_, err = c.TimeConversion()
+	assert.NotNil(t, err)
+	c.TimePrecision = 0
+	c.ZeroDate = "zero"
+	_, err = c.TimeConversion()
+	assert.NotNil(t, err)
 }
 
 func TestRules(t *testing.T) {
@@ -65,6 +185,218 @@ parent = "table1_type"
 	assert.Len(t, cfg.Sources[0].Tables, 2)
 	assert.Equal(t, []string{"table1", "table2"}, cfg.Sources[0].Tables)
 	assert.Len(t, cfg.Rules, 2)
-	assert.Equal(t, &Rule{"test", "table1", "table1_idx", "table1_type", "", "table1.json", nil, nil}, cfg.Rules[0])
-	assert.Equal(t, &Rule{"test", "table2", "table2_idx", "table2_type", "table1_type", "table2.json", nil, nil}, cfg.Rules[1])
+	assert.Equal(t, &Rule{"test", "table1", "table1_idx", "table1_type", "", "table1.json", "", 0, nil, "", false, false, nil, nil, nil}, cfg.Rules[0])
+	assert.Equal(t, &Rule{"test", "table2", "table2_idx", "table2_type", "table1_type", "table2.json", "", 0, nil, "", false, false, nil, nil, nil}, cfg.Rules[1])
+}
+
+func TestExternalVersionGTIDMode(t *testing.T) {
+	cfg, err := NewConfig(`
+gtid_mode = true
+[[source]]
+schema = "test"
+tables = ["t1"]
+[[rule]]
+schema = "test"
+table  = "t1"
+external_version = true
+`)
+	assert.Nil(t, err)
+	_, err = cfg.resolveRules(nil)
+	assert.EqualError(t, err, "external_version of rule test.t1 can't be used with gtid_mode")
+}
+
+func TestMatchWildcard(t *testing.T) {
+	cfg, err := NewConfig(`
+[[source]]
+schema = "test"
+tables = ["table1", "table_[0-9]{4}"]
+[[source]]
+schema = "other"
+tables = ["other_.*"]
+`)
+	assert.Nil(t, err)
+	for table, expected := range map[string]string{
+		"table_0001": "table_[0-9]{4}",
+		"TABLE_0002": "table_[0-9]{4}",
+		"table1":     "",
+		"table_x":    "",
+		"other_1":    "",
+	} {
+		pattern, err := cfg.matchWildcard("test", table)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, pattern, table)
+	}
+	pattern, err := cfg.matchWildcard("other", "other_1")
+	assert.Nil(t, err)
+	assert.Equal(t, "other_.*", pattern)
+}
+
+func TestCompositeDocId(t *testing.T) {
+	rule := NewDefaultRule("test", "t1")
+	rule.TableInfo = &schema.Table{Schema: "test", Name: "t1"}
+	rule.TableInfo.AddColumn("a", "int(11)", "")
+	rule.TableInfo.AddColumn("b", "varchar(600)", "")
+	rule.TableInfo.AddColumn("c", "varchar(10)", "")
+	rule.TableInfo.AddIndexWithColumns("PRIMARY", "b", "a")
+
+	id, err := rule.DocId([]interface{}{int64(1), "x", "y"})
+	assert.Nil(t, err)
+	assert.Equal(t, "x:1", id)
+
+	id, err = rule.DocId([]interface{}{int64(1), []byte("x"), "y"})
+	assert.Nil(t, err)
+	assert.Equal(t, "x:1", id)
+
+	rule.IdSeparator = "|"
+	id, err = rule.DocId([]interface{}{int64(1), "", "y"})
+	assert.Nil(t, err)
+	assert.Equal(t, "|1", id)
+
+	_, err = rule.DocId([]interface{}{nil, "x", "y"})
+	assert.NotNil(t, err)
+	_, err = rule.DocId([]interface{}{int64(1)})
+	assert.NotNil(t, err)
+
+	long := strings.Repeat("x", MaxIdLength)
+	_, err = rule.DocId([]interface{}{int64(1), long, "y"})
+	assert.NotNil(t, err)
+
+	rule.HashLongIds = true
+	id, err = rule.DocId([]interface{}{int64(1), long, "y"})
+	assert.Nil(t, err)
+	assert.Len(t, id, 40)
+	other, err := rule.DocId([]interface{}{int64(2), long, "y"})
+	assert.Nil(t, err)
+	assert.NotEqual(t, id, other)
+
+	id, err = rule.DocId([]interface{}{int64(1), "x", "y"})
+	assert.Nil(t, err)
+	assert.Equal(t, "x|1", id)
+}
+
+func TestBinaryDocId(t *testing.T) {
+	rule := NewDefaultRule("test", "t1")
+	rule.TableInfo = &schema.Table{Schema: "test", Name: "t1"}
+	rule.TableInfo.AddColumn("a", "int(11)", "")
+	rule.TableInfo.AddColumn("b", "binary(16)", "")
+	rule.TableInfo.AddColumn("p", "varbinary(16)", "")
+	rule.TableInfo.AddIndexWithColumns("PRIMARY", "a", "b")
+	rule.Parent = "p"
+
+	// not valid UTF-8
+	row := []interface{}{int64(1), []byte{0xff, 0x00, 0x3a}, "\xfe"}
+	id, err := rule.DocId(row)
+	assert.Nil(t, err)
+	assert.Equal(t, "1:ff003a", id)
+	parentId, err := rule.ParentId(row)
+	assert.Nil(t, err)
+	assert.Equal(t, "fe", parentId)
+}
+
+func TestDocIdWithoutPK(t *testing.T) {
+	rule := NewDefaultRule("test", "t1")
+	rule.TableInfo = &schema.Table{Schema: "test", Name: "t1"}
+	rule.TableInfo.AddColumn("a", "int(11)", "")
+	rule.TableInfo.AddColumn("b", "varchar(10)", "")
+	rule.TableInfo.AddColumn("c", "varchar(10)", "")
+	row := []interface{}{int64(1), "x", "y"}
+
+	_, err := rule.DocId(row)
+	assert.NotNil(t, err)
+
+	// The first unique index on NOT NULL columns identifies the row
+	rule.TableInfo.AddIndexWithColumns("c_idx", "c").Unique = true
+	rule.TableInfo.Columns[2].IsNullable = true
+	rule.TableInfo.AddIndexWithColumns("b_idx", "b", "a").Unique = true
+	id, err := rule.DocId(row)
+	assert.Nil(t, err)
+	assert.Equal(t, "x:1", id)
+
+	rule.IdColumns = []string{"c"}
+	id, err = rule.DocId(row)
+	assert.Nil(t, err)
+	assert.Equal(t, "y", id)
+
+	rule.IdColumns = []string{"missing"}
+	_, err = rule.DocId(row)
+	assert.NotNil(t, err)
+}
+
+func TestIdColumns(t *testing.T) {
+	cfg, err := NewConfig(`
+[[rule]]
+schema = "test"
+table  = "table1"
+id_columns = ["a", "b"]
+id_separator = "-"
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, cfg.Rules[0].IdColumns)
+	assert.Equal(t, "-", cfg.Rules[0].IdSeparator)
+}
+
+// Reads every table with the same columns
+type fakeTables struct{}
+
+func (fakeTables) GetTable(db string, table string) (*schema.Table, error) {
+	t := &schema.Table{Schema: db, Name: table}
+	t.AddColumn("id", "int(11)", "")
+	t.AddIndexWithColumns("PRIMARY", "id")
+	return t, nil
+}
+
+func TestCutoverRename(t *testing.T) {
+	cfg, err := NewConfig(`
+[[source]]
+schema = "test"
+tables = ["t1", "w_.*"]
+[[rule]]
+schema = "test"
+table  = "t1"
+index  = "t1_idx"
+on_drop = "delete_index"
+`)
+	assert.Nil(t, err)
+	rule := cfg.Rules[0]
+	assert.Nil(t, rule.Prepare())
+	rt := &Runtime{config: cfg, canal: fakeTables{}, Rules: map[string]*Rule{ruleKey("test", "t1"): rule}}
+
+	// RENAME TABLE t1 TO _t1_old, _t1_gho TO t1, as the river handles it
+	assert.Nil(t, rt.RenameRule("test", "t1", "test", "_t1_old", true))
+	added, err := rt.AddTable("test", "_t1_old")
+	assert.Nil(t, err)
+	assert.Nil(t, added)
+	assert.Nil(t, rt.RenameRule("test", "_t1_gho", "test", "t1", false))
+	added, err = rt.AddTable("test", "t1")
+	assert.Nil(t, err)
+	if assert.NotNil(t, added) {
+		assert.Equal(t, "t1_idx", added.Index)
+		assert.Equal(t, OnDropDeleteIndex, added.OnDrop)
+		assert.Equal(t, "t1", added.TableInfo.Name)
+	}
+
+	// DROP TABLE _t1_old leaves t1 synced
+	assert.Nil(t, rt.RemoveRule("test", "_t1_old"))
+	assert.Equal(t, added, rt.GetRule("test", "t1"))
+	assert.Len(t, rt.Rules, 1)
+
+	// a table matching a wildcard keeps its rule across a rename, as a copy
+	wild, err := rt.AddTable("test", "w_1")
+	assert.Nil(t, err)
+	renamed := rt.RenameRule("test", "w_1", "test", "archive_1", false)
+	if assert.NotNil(t, renamed) {
+		assert.Equal(t, "archive_1", renamed.Table)
+		assert.Equal(t, "w_1", wild.Table)
+	}
+	assert.Nil(t, rt.GetRule("test", "w_1"))
+	assert.Equal(t, renamed, rt.GetRule("test", "archive_1"))
+
+	// and so does a named table renamed on its own
+	renamed = rt.RenameRule("test", "t1", "test", "t1_new", false)
+	if assert.NotNil(t, renamed) {
+		assert.Equal(t, "t1_new", renamed.Table)
+		assert.Equal(t, "t1_idx", renamed.Index)
+	}
+	assert.Nil(t, rt.GetRule("test", "t1"))
+	assert.Equal(t, renamed, rt.GetRule("test", "t1_new"))
 }
@@ -2,9 +2,10 @@ package config
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 
-	"github.com/ehalpern/go-mysql/canal"
 	"github.com/ehalpern/go-mysql/schema"
 	"github.com/juju/errors"
 )
@@ -20,6 +21,31 @@ type Rule struct {
 	Parent string `toml:"parent"`
 	IndexFile string `toml:"indexFile"`
 
+	// What to do with the table's documents when the table is dropped: keep them
+	// (default), delete them, or delete the whole index
+	OnDrop string `toml:"on_drop"`
+
+	// Number of versions of the index to keep. When set, the index is an alias of
+	// its current version <index>-N, which a reindex replaces without downtime.
+	// Must be the same for every table synced into the index.
+	Versions int `toml:"versions"`
+
+	// Columns whose values form the document id. By default the PK, or the first
+	// unique index on NOT NULL columns for tables without a PK.
+	IdColumns []string `toml:"id_columns"`
+
+	// Separates the values of a multi column id in document ids, ":" by default
+	IdSeparator string `toml:"id_separator"`
+
+	// Replace ids longer than Elasticsearch allows by their SHA-1 digest rather
+	// than skipping the row
+	HashLongIds bool `toml:"hash_long_ids"`
+
+	// Send index and delete requests with an external version derived from the
+	// binlog position of the row, so Elasticsearch rejects an older row image
+	// written over a newer one. Updates are sent as whole documents.
+	ExternalVersion bool `toml:"external_version"`
+
 	// Default, a MySQL table field name is mapped to Elasticsearch field name.
 	// Sometimes, you want to use different name, e.g, the MySQL file name is title,
 	// but in Elasticsearch, you want to name it my_title.
@@ -27,8 +53,24 @@ type Rule struct {
 
 	// MySQL table information
 	TableInfo *schema.Table
+
+	// How temporal values are converted, the same for every rule
+	TimeConversion *TimeConversion `toml:"-"`
 }
 
+const (
+	DefaultIdSeparator = ":"
+
+	// Elasticsearch rejects ids longer than this many bytes
+	MaxIdLength = 512
+)
+
+const (
+	OnDropKeep        = ""
+	OnDropDelete      = "delete"
+	OnDropDeleteIndex = "delete_index"
+)
+
 func NewDefaultRule(schema string, table string) *Rule {
 	r := new(Rule)
 
@@ -36,6 +78,7 @@ func NewDefaultRule(schema string, table string) *Rule {
 	r.Table = table
 	r.Index = table
 	r.Type = table
+	r.IdSeparator = DefaultIdSeparator
 	r.FieldMapping = make(map[string]string)
 
 	return r
@@ -54,14 +97,29 @@ func (r *Rule) Prepare() error {
 		r.Type = r.Index
 	}
 
+	if len(r.IdSeparator) == 0 {
+		r.IdSeparator = DefaultIdSeparator
+	}
+
+	if r.Versions < 0 {
+		return errors.Errorf("invalid versions %d for rule %s.%s", r.Versions, r.Schema, r.Table)
+	}
+
+	switch r.OnDrop {
+	case OnDropKeep, OnDropDelete, OnDropDeleteIndex:
+	default:
+		return errors.Errorf("invalid on_drop '%s' for rule %s.%s", r.OnDrop, r.Schema, r.Table)
+	}
+
 	return nil
 }
 
 
-// Returns a doc id synthesized by concatenating all primary key values in the row.
-// The resulting id will have the form pk1[:pk2[...]]
+// Returns a doc id synthesized by concatenating the values of the id columns in the
+// row. The resulting id will have the form pk1[:pk2[...]], where ":" is the IdSeparator.
+// Binary values are hex encoded.
 func (r *Rule) DocId(row []interface{}) (string, error) {
-	pks, err := canal.GetPKValues(r.TableInfo, row)
+	columns, err := r.idColumns()
 	if err != nil {
 		return "", err
 	}
@@ -69,18 +127,65 @@ func (r *Rule) DocId(row []interface{}) (string, error) {
 	var buf bytes.Buffer
 
 	sep := ""
-	for i, value := range pks {
-		if value == nil {
-			return "", errors.Errorf("The %ds PK value is nil", i)
+	for i, column := range columns {
+		if column >= len(row) || row[column] == nil {
+			return "", errors.Errorf("The %ds id value is nil", i)
 		}
 
-		buf.WriteString(fmt.Sprintf("%s%v", sep, value))
-		sep = ":"
+		buf.WriteString(sep)
+		buf.WriteString(r.idValue(column, row[column]))
+		sep = r.IdSeparator
 	}
 
-	return buf.String(), nil
+	id := buf.String()
+	if len(id) == 0 {
+		return "", errors.Errorf("id value is empty")
+	} else if len(id) > MaxIdLength {
+		if !r.HashLongIds {
+			return "", errors.Errorf("id '%.32s...' is longer than %d bytes", id, MaxIdLength)
+		}
+		sum := sha1.Sum([]byte(id))
+		id = hex.EncodeToString(sum[:])
+	}
+	return id, nil
 }
 
+// Returns the positions of the columns forming the document id. Resolved for each
+// row since the table's columns may be altered.
+func (r *Rule) idColumns() ([]int, error) {
+	if len(r.IdColumns) == 0 {
+		if columns := r.TableInfo.UniqueKeyColumns(); len(columns) > 0 {
+			return columns, nil
+		}
+		return nil, errors.Errorf("table %s has no PK or unique index on NOT NULL columns; set id_columns", r.TableInfo)
+	}
+	columns := make([]int, len(r.IdColumns))
+	for i, name := range r.IdColumns {
+		if columns[i] = r.TableInfo.FindColumn(name); columns[i] < 0 {
+			return nil, errors.Errorf("id column '%s' not found in table '%s'", name, r.TableInfo)
+		}
+	}
+	return columns, nil
+}
+
+// Returns the value of the column as it appears in ids. Values of binary columns
+// needn't be valid UTF-8, which ids must be, so they're hex encoded.
+func (r *Rule) idValue(column int, value interface{}) string {
+	binary := column < len(r.TableInfo.Columns) && r.TableInfo.Columns[column].Type == schema.TYPE_BINARY
+	switch value := value.(type) {
+	case []byte:
+		if binary {
+			return hex.EncodeToString(value)
+		}
+		return string(value)
+	case string:
+		if binary {
+			return hex.EncodeToString([]byte(value))
+		}
+		return value
+	}
+	return fmt.Sprint(value)
+}
 
 func (r *Rule) ParentId(row []interface{}) (string, error) {
 	if len(r.Parent) == 0 {
@@ -90,7 +195,7 @@ func (r *Rule) ParentId(row []interface{}) (string, error) {
 		if index < 0 {
 			return "", errors.Errorf("parent column '%s' not found in table '%s'", r.Parent, r.TableInfo.Name)
 		}
-		return fmt.Sprint(row[index]), nil
+		return r.idValue(index, row[index]), nil
 	}
 }
 
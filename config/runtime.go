@@ -3,28 +3,141 @@ package config
 import (
 	"fmt"
 	"regexp"
+	"sync"
+
 	"github.com/ehalpern/go-mysql/canal"
+	"github.com/ehalpern/go-mysql/schema"
 	"github.com/juju/errors"
+	"github.com/siddontang/go/log"
 )
 
+// Reads table definitions, the river's canal
+type tableSource interface {
+	GetTable(db string, table string) (*schema.Table, error)
+}
+
 type Runtime struct {
 	config *Config
+	canal  tableSource
+	time   *TimeConversion
+
+	// guards Rules once replication has started
+	l     sync.RWMutex
 	Rules map[string]*Rule
 }
 
 func NewRuntime(config *Config, canal *canal.Canal) (*Runtime, error) {
+	time, err := config.TimeConversion()
+	if err != nil {
+		return nil, err
+	}
 	rules, err := config.resolveRules(canal)
 	if err != nil {
 		return nil, err
 	}
-	return &Runtime{config, rules}, nil
+	for _, rule := range rules {
+		rule.TimeConversion = time
+	}
+	return &Runtime{config: config, canal: canal, time: time, Rules: rules}, nil
 }
 
 func (c *Runtime) GetRule(schema string, table string) *Rule {
+	c.l.RLock()
+	defer c.l.RUnlock()
 	return c.Rules[ruleKey(schema, table)]
 }
 
+// Returns every rule syncing into the index
+func (c *Runtime) IndexRules(index string) []*Rule {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	var rules []*Rule
+	for _, r := range c.Rules {
+		if r.Index == index {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// Starts syncing a table created or renamed after startup if it's a source table.
+// A table the sources name is given its configured rule again, replacing any it
+// had, while one matching a wildcard source table keeps the rule it has. Returns
+// the table's rule, or nil if the table isn't synced.
+func (c *Runtime) AddTable(schema string, table string) (*Rule, error) {
+	var rule *Rule
+	var matching string
+	if c.config.isNamedSource(schema, table) {
+		rule = c.config.namedRule(schema, table)
+	} else {
+		if rule := c.GetRule(schema, table); rule != nil {
+			return rule, nil
+		}
+		pattern, err := c.config.matchWildcard(schema, table)
+		if err != nil || len(pattern) == 0 {
+			return nil, err
+		}
+		matching = " matching " + pattern
+		rule = NewDefaultRule(schema, table)
+		for _, r := range c.config.Rules {
+			if r.Schema == schema && r.Table == pattern {
+				applyWildcardRule(rule, r)
+			}
+		}
+	}
+	if err := loadTableInfo(c.canal, rule); err != nil {
+		return nil, err
+	}
+	rule.TimeConversion = c.time
+
+	c.l.Lock()
+	c.Rules[ruleKey(schema, table)] = rule
+	c.l.Unlock()
+	log.Infof("Syncing new table %s.%s%s into %s/%s", schema, table, matching, rule.Index, rule.Type)
+	return rule, nil
+}
+
+// Stops syncing the table, returning its rule or nil if it wasn't synced
+func (c *Runtime) RemoveRule(schema string, table string) *Rule {
+	key := ruleKey(schema, table)
+	c.l.Lock()
+	defer c.l.Unlock()
+	rule := c.Rules[key]
+	delete(c.Rules, key)
+	return rule
+}
+
+// Moves the table's rule to its new name, returning the new rule or nil if the
+// rule wasn't moved. The rule keeps syncing into the same index and type. When the
+// table is replaced, another table being renamed to its name as online schema
+// change tools do, a table the sources name keeps its rule for the table that
+// replaces it. A table renamed to a name the sources name is added instead.
+func (c *Runtime) RenameRule(schema string, table string, newSchema string, newTable string, replaced bool) *Rule {
+	if replaced && c.config.isNamedSource(schema, table) {
+		return nil
+	}
+	key := ruleKey(schema, table)
+	c.l.Lock()
+	defer c.l.Unlock()
+	rule := c.Rules[key]
+	if rule == nil {
+		return nil
+	}
+	delete(c.Rules, key)
+	if c.config.isNamedSource(newSchema, newTable) {
+		return nil
+	}
+	// the rule may be in use, so is copied rather than renamed
+	renamed := *rule
+	renamed.Schema = newSchema
+	renamed.Table = newTable
+	c.Rules[ruleKey(newSchema, newTable)] = &renamed
+	return &renamed
+}
+
 func (c *Runtime) DBsAndTables() ([]string, []string) {
+	c.l.RLock()
+	defer c.l.RUnlock()
 	dbSet := map[string]struct{}{}
 	tables := make([]string, 0, len(c.Rules))
 	for _, r := range c.Rules {
@@ -39,6 +152,15 @@ func (c *Runtime) DBsAndTables() ([]string, []string) {
 }
 
 func (c *Config) resolveRules(canal *canal.Canal) (map[string]*Rule, error) {
+	for _, rule := range c.Rules {
+		// GTID mode resumes on any server, whose binlog positions version rows
+		// differently
+		if rule.ExternalVersion && c.GTIDMode {
+			return nil, errors.Errorf("external_version of rule %s.%s can't be used with gtid_mode",
+				rule.Schema, rule.Table)
+		}
+	}
+
 	ruleMap, wildtables, err := c.parseSource(canal)
 	if err != nil {
 		return nil, err
@@ -62,39 +184,108 @@ func (c *Config) resolveRules(canal *canal.Canal) (map[string]*Rule, error) {
 					return nil, errors.Errorf("wildcard table rule %s.%s must have a index, can not empty", rule.Schema, rule.Table)
 				}
 
-				rule.Prepare()
+				if err := rule.Prepare(); err != nil {
+					return nil, err
+				}
 
 				for _, table := range tables {
-					rr := ruleMap[ruleKey(rule.Schema, table)]
-					rr.Index = rule.Index
-					rr.Type = rule.Type
-					rr.Parent = rule.Parent
-					rr.FieldMapping = rule.FieldMapping
+					applyWildcardRule(ruleMap[ruleKey(rule.Schema, table)], rule)
 				}
 			} else {
 				key := ruleKey(rule.Schema, rule.Table)
 				if _, ok := ruleMap[key]; !ok {
 					return nil, errors.Errorf("rule %s, %s not defined in source", rule.Schema, rule.Table)
 				}
-				rule.Prepare()
+				if err := rule.Prepare(); err != nil {
+					return nil, err
+				}
 				ruleMap[key] = rule
 			}
 		}
 	}
 
 	for _, rule := range ruleMap {
-		if rule.TableInfo, err = canal.GetTable(rule.Schema, rule.Table); err != nil {
+		if err := loadTableInfo(canal, rule); err != nil {
 			return nil, err
 		}
+	}
+
+	return ruleMap, nil
+}
+
+// Applies the settings of a wildcard table rule to the rule of a matching table
+func applyWildcardRule(rr *Rule, rule *Rule) {
+	rr.Index = rule.Index
+	rr.Type = rule.Type
+	rr.Parent = rule.Parent
+	rr.FieldMapping = rule.FieldMapping
+	rr.OnDrop = rule.OnDrop
+	rr.Versions = rule.Versions
+	rr.IdColumns = rule.IdColumns
+	rr.IdSeparator = rule.IdSeparator
+	rr.HashLongIds = rule.HashLongIds
+	rr.ExternalVersion = rule.ExternalVersion
+}
+
+func loadTableInfo(canal tableSource, rule *Rule) error {
+	var err error
+	if rule.TableInfo, err = canal.GetTable(rule.Schema, rule.Table); err != nil {
+		return err
+	}
+
+	// table must have columns identifying each row, multi column ids are joined
+	_, err = rule.idColumns()
+	return err
+}
 
-		// table must have a PK for one column, multi columns may be supported later.
+// Returns whether a source names schema.table rather than matching it by wildcard
+func (c *Config) isNamedSource(schema string, table string) bool {
+	for _, s := range c.Sources {
+		if s.Schema != schema {
+			continue
+		}
+		for _, t := range s.Tables {
+			if t == table && regexp.QuoteMeta(t) == t {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-		if len(rule.TableInfo.PKColumns) != 1 {
-			return nil, errors.Errorf("%s.%s must have a PK for a column", rule.Schema, rule.Table)
+// Returns a copy of the rule configured for a table the sources name, or its
+// default rule if none is
+func (c *Config) namedRule(schema string, table string) *Rule {
+	for _, r := range c.Rules {
+		if r.Schema == schema && r.Table == table {
+			rule := *r
+			return &rule
 		}
 	}
+	return NewDefaultRule(schema, table)
+}
 
-	return ruleMap, nil
+// Returns the wildcard source table in schema that table matches, or "" if none.
+// Matches the same way as the RLIKE used to find the tables at startup.
+func (c *Config) matchWildcard(schema string, table string) (string, error) {
+	for _, s := range c.Sources {
+		if s.Schema != schema {
+			continue
+		}
+		for _, pattern := range s.Tables {
+			if regexp.QuoteMeta(pattern) == pattern {
+				continue
+			}
+			re, err := regexp.Compile("(?i)" + pattern)
+			if err != nil {
+				return "", errors.Annotatef(err, "wildcard table %s.%s", schema, pattern)
+			}
+			if re.MatchString(table) {
+				return pattern, nil
+			}
+		}
+	}
+	return "", nil
 }
 
 func (c *Config) parseSource(canal *canal.Canal) (map[string]*Rule, map[string][]string, error) {
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// Zero dates such as 0000-00-00 are sent as null
+	ZeroDateNull = "null"
+	// or as they are
+	ZeroDateKeep = "keep"
+	// or as the Unix epoch
+	ZeroDateEpoch = "epoch"
+)
+
+// Maximum fractional second digits of a MySQL temporal value
+const MaxTimePrecision = 6
+
+// How DATETIME, TIMESTAMP, DATE and TIME values are converted to ISO-8601
+type TimeConversion struct {
+	// Zone of DATETIME values, which MySQL stores without one. TIMESTAMP values
+	// are always read in UTC.
+	Location *time.Location
+
+	// Fractional second digits kept, or -1 to keep as many as the column has
+	Precision int
+
+	// What zero dates become
+	ZeroDate string
+}
+
+// Converts datetimes as UTC, keeping the precision of the column and sending zero
+// dates as null
+var DefaultTimeConversion = &TimeConversion{time.UTC, -1, ZeroDateNull}
+
+// Returns the conversion of temporal values configured by db_time_zone,
+// time_precision and zero_date
+func (c *Config) TimeConversion() (*TimeConversion, error) {
+	loc, err := time.LoadLocation(c.DbTimeZone)
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid db_time_zone '%s'", c.DbTimeZone)
+	}
+	if c.TimePrecision < -1 || c.TimePrecision > MaxTimePrecision {
+		return nil, errors.Errorf("invalid time_precision %d, must be -1 to %d", c.TimePrecision, MaxTimePrecision)
+	}
+	switch c.ZeroDate {
+	case ZeroDateNull, ZeroDateKeep, ZeroDateEpoch:
+	default:
+		return nil, errors.Errorf("invalid zero_date '%s'", c.ZeroDate)
+	}
+	return &TimeConversion{loc, c.TimePrecision, c.ZeroDate}, nil
+}
@@ -24,8 +24,11 @@ var options = struct {
 	dbPassword   *string
 	dbSlaveID    *int
 	esHost       *string
+	esUser       *string
+	esPassword   *string
 	esMaxActions *int
 	reuseDump    *string
+	replayDeadLetters *bool
 }{
 	flag.Bool("help", false, "show help"),
 	flag.String("service", "", "install|remove|[re]start|stop|status"),
@@ -34,10 +37,13 @@ var options = struct {
 	flag.String("db_host", "", fmt.Sprintf("DB host and port (%s)", config.Default.DbHost)),
 	flag.String("db_user", "", fmt.Sprintf("DB user (%s)", config.Default.DbUser)),
 	flag.String("db_pass", "", fmt.Sprintf("DB password (%s)", config.Default.DbPassword)),
-	flag.Int("db_slave_id", 1001, fmt.Sprintf("MySQL slave id (%s)", config.Default.DbSlaveID)),
+	flag.Int("db_slave_id", 1001, fmt.Sprintf("MySQL slave id (%d)", config.Default.DbSlaveID)),
 	flag.String("es_host", "", fmt.Sprintf("Elasticsearch host and port (%s)", config.Default.EsHost)),
-	flag.Int("es_max_actions", config.Default.EsMaxActions, fmt.Sprintf("maximum elasticsearch bulk update size (%s)", config.Default.EsMaxActions)),
+	flag.String("es_user", "", "Elasticsearch user"),
+	flag.String("es_pass", "", "Elasticsearch password"),
+	flag.Int("es_max_actions", config.Default.EsMaxActions, fmt.Sprintf("maximum elasticsearch bulk update size (%d)", config.Default.EsMaxActions)),
 	flag.String("use_dump", "", "use dump stored in this directory rather than generating new dump"),
+	flag.Bool("replay_dead_letters", false, "resubmit the actions elasticsearch rejected, then exit"),
 }
 
 func main() {
@@ -56,6 +62,8 @@ func main() {
 
 	if *options.service != "" {
 		status, err = invokeService(*options.service)
+	} else if *options.replayDeadLetters {
+		status, err = replayDeadLetters()
 	} else {
 		err = runNormally()
 	}
@@ -90,18 +98,15 @@ func invokeService(cmd string) (string, error) {
 	case "status":
 		return s.Status()
 	default:
-		return "", errors.Errorf("unrecognized -service option " + cmd)
+		return "", errors.Errorf("unrecognized -service option %s", cmd)
 	}
 }
 
-func runNormally() error {
-	runtime.GOMAXPROCS(runtime.NumCPU())
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt, os.Kill, syscall.SIGTERM)
-
+// Loads the config file, overridden by any options given
+func loadConfig() (*config.Config, error) {
 	cfg, err := config.NewConfigWithFile(*options.config)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if len(*options.dbHost) > 0 {
@@ -119,12 +124,42 @@ func runNormally() error {
 	if len(*options.esHost) > 0 {
 		cfg.EsHost = *options.esHost
 	}
+	if len(*options.esUser) > 0 {
+		cfg.EsUser = *options.esUser
+	}
+	if len(*options.esPassword) > 0 {
+		cfg.EsPassword = *options.esPassword
+	}
 	if len(*options.dataDir) > 0 {
 		cfg.DataDir = *options.dataDir
 	}
 	if *options.esMaxActions > 0 {
 		cfg.EsMaxActions = *options.esMaxActions
 	}
+	return cfg, nil
+}
+
+func replayDeadLetters() (string, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return "", err
+	}
+	count, err := river.ReplayDeadLetters(cfg)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("replayed %d dead-lettered actions", count), nil
+}
+
+func runNormally() error {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, os.Kill, syscall.SIGTERM)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
 
 	river, err := river.NewRiver(cfg)
 	if err != nil {
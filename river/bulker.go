@@ -2,27 +2,111 @@ package river
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/juju/errors"
 	"gopkg.in/olivere/elastic.v3"
 	"github.com/siddontang/go/log"
 )
 
-// Bulker is used to build and submit bulk requests to elasticsearch.
+const (
+	DefaultMaxRetries   = 15
+	DefaultRetryBackoff = 100 * time.Millisecond
+	MaxRetryBackoff     = 30 * time.Second
+	DefaultWorkers      = 4
+	DefaultQueueSize    = 2
+	DefaultFlushInterval = time.Second
+)
+
+var errBulkerClosed = errors.New("bulker closed")
+
+// Bulker is used to build and submit bulk requests to elasticsearch. Actions are
+// partitioned by index and document id among Workers, each sending the batches of
+// its partition in order, so up to Workers bulk requests are in flight while the
+// changes to any one document are still applied in the order they were added.
+// Once QueueSize batches are waiting for a worker, adding to its partition blocks.
+//
+// Each Add is numbered, in order, and OnAcknowledged reports the number of the
+// latest Add that Elasticsearch has acknowledged along with every Add before it.
 type Bulker struct {
-	bulker       *elastic.BulkService  // Underlying service for building a submitting requests
-	MaxActions   int                   // When this # of actions have been added, request is auto submitted
-	MaxBytes     int64
-	Stats        *BulkerStats          // Statistics
-	LastError    error                 // Error, if any, from last Submit
-	LastResponse *elastic.BulkResponse // Response, if any, from last Submit
+	es             *elastic.Client
+	MaxActions     int                 // When a partition has this # of actions, its batch is sent
+	MaxBytes       int64
+	MaxRetries     int                 // Retries of a batch, or of its actions, failing with a retryable error
+	RetryBackoff   time.Duration       // Wait before the first retry, doubled for each one after
+	Workers        int                 // Partitions, and bulk requests in flight at once
+	QueueSize      int                 // Batches waiting for each worker before Add blocks
+	FlushInterval  time.Duration       // Longest an action waits for its batch to fill, unless 0
+	DeadLetters    *DeadLetterQueue    // Receives, if set, actions Elasticsearch rejected
+	Stats          *BulkerStats        // Statistics
+	OnAcknowledged func(seq uint64)    // Called, if set, as Adds are acknowledged
+	OnError        func(error)         // Called, if set, when a batch or some of its actions fail
+
+	start   sync.Once
+	workers []*bulkWorker
+	wg      sync.WaitGroup
+	quit    chan struct{}
+	// held while batches are dispatched, so each worker gets them in the order
+	// they were built
+	dl sync.Mutex
+	// serializes OnAcknowledged
+	al    sync.Mutex
+	acked uint64
+
+	// guards the fields below
+	m       sync.Mutex
+	drained *sync.Cond
+	added   uint64 // number of the last Add
+	pending int    // actions added but not acknowledged
+	acking  int    // batches acknowledged whose OnAcknowledged hasn't returned
+	err     error  // first batch to fail for good, after which nothing more is sent
+	closed  bool
 }
 
 type BulkerStats struct {
-	InsertCount int
-	UpdateCount int
-	DeleteCount int
-	Total       int
+	InsertCount int `json:"insert_count"`
+	UpdateCount int `json:"update_count"`
+	DeleteCount int `json:"delete_count"`
+	Total       int `json:"total"`
+}
+
+// Sends the batches of one partition
+type bulkWorker struct {
+	queue chan *bulkBatch
+	// being built
+	batch *bulkBatch
+	// dispatched but not acknowledged, in order
+	sent []*bulkBatch
+}
+
+type bulkBatch struct {
+	worker   *bulkWorker
+	service  *elastic.BulkService
+	requests []elastic.BulkableRequest // Actions added, in order
+	sources  []*ActionSource           // Source of each action added, nil if unknown
+	first    uint64                    // Number of the first Add with actions in the batch
+	size     int
+}
+
+// Counts the actions by kind
+func (s *BulkerStats) Add(actions []elastic.BulkableRequest) {
+	for _, req := range actions {
+		switch req.(type) {
+		case *elastic.BulkDeleteRequest:
+			s.DeleteCount++
+		case *elastic.BulkIndexRequest:
+			s.InsertCount++
+		case *elastic.BulkUpdateRequest:
+			s.UpdateCount++
+		}
+		s.Total++
+	}
 }
 
 // NewBulker constructs a new Bulker
@@ -30,72 +114,489 @@ func NewBulker(es *elastic.Client, maxActions int, maxBytes int64) *Bulker {
 	if maxActions == 0 {
 		maxActions = 1
 	}
-	return &Bulker{ es.Bulk(), maxActions, maxBytes, new(BulkerStats), nil, nil }
+	b := &Bulker{
+		es:           es,
+		MaxActions:   maxActions,
+		MaxBytes:     maxBytes,
+		MaxRetries:   DefaultMaxRetries,
+		RetryBackoff: DefaultRetryBackoff,
+		Workers:      DefaultWorkers,
+		QueueSize:    DefaultQueueSize,
+		FlushInterval: DefaultFlushInterval,
+		Stats:        new(BulkerStats),
+		quit:         make(chan struct{}),
+	}
+	b.drained = sync.NewCond(&b.m)
+	return b
 }
 
-// Count returns the number of actions added since the last Submit
+// Starts the workers, once Workers and QueueSize are final
+func (b *Bulker) startWorkers() {
+	b.start.Do(func() {
+		n := b.Workers
+		if n < 1 {
+			n = 1
+		}
+		size := b.QueueSize
+		if size < 0 {
+			size = 0
+		}
+		for i := 0; i < n; i++ {
+			w := &bulkWorker{queue: make(chan *bulkBatch, size)}
+			b.workers = append(b.workers, w)
+			b.wg.Add(1)
+			go b.run(w)
+		}
+		if b.FlushInterval > 0 {
+			b.wg.Add(1)
+			go b.runFlusher()
+		}
+	})
+}
+
+// Flushes every FlushInterval, so actions are sent however slowly batches fill
+func (b *Bulker) runFlusher() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.Flush(); err != nil {
+				log.Debugf("Skipping flush: %v", err)
+			}
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+// Count returns the number of actions added but not yet acknowledged
 func (b *Bulker) Count() int {
-	return b.bulker.NumberOfActions()
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.pending
+}
+
+// Added returns the number of the last Add
+func (b *Bulker) Added() uint64 {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.added
 }
 
-// Adds actions to be submitted in the next request. If adding these actions causes
-// count to exceed MaxActions, auto-submits the current batch by calling Submit.
+// Adds actions to be submitted in the next request. Sends the batch of each
+// partition reaching MaxActions or MaxBytes, blocking while the partition's queue
+// is full. Returns the error of any batch that failed for good.
 func (b *Bulker) Add(actions []elastic.BulkableRequest) error {
+	return b.AddFrom(nil, actions)
+}
 
+// Adds actions converted from the source, which is recorded with any of them
+// that are dead-lettered
+func (b *Bulker) AddFrom(source *ActionSource, actions []elastic.BulkableRequest) error {
+	b.startWorkers()
+	b.dl.Lock()
+	defer b.dl.Unlock()
+
+	b.m.Lock()
+	if err := b.failure(); err != nil {
+		b.m.Unlock()
+		return err
+	}
+	b.added++
+	b.Stats.Add(actions)
+	var full []*bulkBatch
 	for _, req := range actions {
-		switch req.(type) {
-		case *elastic.BulkDeleteRequest:
-			b.Stats.DeleteCount++
-		case *elastic.BulkIndexRequest:
-			b.Stats.InsertCount++
-		case *elastic.BulkUpdateRequest:
-			b.Stats.UpdateCount++
-		}
-		b.Stats.Total++
 		log.Debugf("Adding %s\n", req.String())
-		b.bulker.Add(req)
+		w := b.workers[b.partition(req)]
+		if w.batch == nil {
+			w.batch = &bulkBatch{worker: w, service: b.es.Bulk(), first: b.added}
+		}
+		w.batch.add(req, source)
+		b.pending++
+		if w.batch.service.EstimatedSizeInBytes() >= b.MaxBytes || w.batch.size >= b.MaxActions {
+			full = append(full, b.dispatch(w))
+		}
 	}
+	bulkQueueDepth.set(float64(b.pending))
+	b.m.Unlock()
 
-	if b.bulker.EstimatedSizeInBytes() >= b.MaxBytes {
-		b.Submit()
-	} else if (b.bulker.NumberOfActions() >= b.MaxActions) {
-		b.Submit()
-	}
-	return b.LastError
+	b.send(full)
+	return b.Err()
 }
 
+// Flush sends the batch of every partition without waiting for them to be acknowledged
+func (b *Bulker) Flush() error {
+	b.startWorkers()
+	b.dl.Lock()
+	defer b.dl.Unlock()
+
+	b.m.Lock()
+	if err := b.failure(); err != nil {
+		b.m.Unlock()
+		return err
+	}
+	var batches []*bulkBatch
+	for _, w := range b.workers {
+		if w.batch != nil {
+			batches = append(batches, b.dispatch(w))
+		}
+	}
+	b.m.Unlock()
 
+	b.send(batches)
+	return nil
+}
 
-// Submit submits the current batch of actions in bulk and resets Count to 0.
+// Submit sends the batch of every partition and waits for Elasticsearch to
+// acknowledge every action added. Requests and actions failing with retryable
+// errors are retried with backoff. Actions Elasticsearch rejects are dead-lettered,
+// and their batch is then acknowledged anyway.
 func (b *Bulker) Submit() error {
-	size := b.bulker.NumberOfActions()
-	if (size == 0) {
-		return nil
-	}
-	b.LastResponse, b.LastError = b.bulker.Do()
-	if b.LastError != nil {
-		log.Errorf("Bulk update %d/%d failed due to %v: %+v", size, b.MaxActions, b.LastError, b.LastResponse)
-		return b.LastError
-	}
-	if b.LastResponse.Errors {
-		var buffer bytes.Buffer
-		failed := b.LastResponse.Failed()
-		count := len(failed)
-		buffer.WriteString(fmt.Sprintf("%v actions failed in bulk update:\n", count))
-		for i, er := range failed {
-			buffer.WriteString(fmt.Sprintf("\t%v:%v\n", er, er.Error))
-			if i == 2 {
-				if count > 3 {
-					buffer.WriteString(fmt.Sprintf("\t...\n"))
-				}
-				break;
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	for (b.pending > 0 || b.acking > 0) && b.err == nil {
+		b.drained.Wait()
+	}
+	return b.err
+}
+
+// Err returns the error of the batch that failed for good, if any. Nothing more is
+// sent once one has.
+func (b *Bulker) Err() error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.err
+}
+
+// Close submits the actions added and stops the workers
+func (b *Bulker) Close() error {
+	b.startWorkers()
+	err := b.Submit()
+	b.dl.Lock()
+	b.m.Lock()
+	closed := b.closed
+	b.closed = true
+	b.m.Unlock()
+	if !closed {
+		close(b.quit)
+		for _, w := range b.workers {
+			close(w.queue)
+		}
+	}
+	b.dl.Unlock()
+	b.wg.Wait()
+	return err
+}
+
+// Returns why nothing more can be added, if so. Must be locked.
+func (b *Bulker) failure() error {
+	if b.err != nil {
+		return b.err
+	} else if b.closed {
+		return errBulkerClosed
+	}
+	return nil
+}
+
+// Takes the worker's batch to send. Must be locked.
+func (b *Bulker) dispatch(w *bulkWorker) *bulkBatch {
+	batch := w.batch
+	w.batch = nil
+	w.sent = append(w.sent, batch)
+	return batch
+}
+
+// Queues the batches for their workers, blocking while a queue is full. Must hold dl.
+func (b *Bulker) send(batches []*bulkBatch) {
+	for _, batch := range batches {
+		batch.worker.queue <- batch
+	}
+}
+
+func (b *Bulker) run(w *bulkWorker) {
+	defer b.wg.Done()
+	for batch := range w.queue {
+		err := b.Err()
+		if err == nil {
+			err = b.submit(batch)
+		}
+		b.acknowledge(w, batch, err)
+	}
+}
+
+// Records that the worker's oldest batch was sent, or failed, and reports the Adds
+// now acknowledged
+func (b *Bulker) acknowledge(w *bulkWorker, batch *bulkBatch, err error) {
+	b.m.Lock()
+	if err != nil {
+		// leaves the batch unacknowledged, so nothing after it is either
+		if b.err == nil {
+			b.err = err
+		}
+		b.drained.Broadcast()
+		b.m.Unlock()
+		return
+	}
+	w.sent = w.sent[1:]
+	b.pending -= batch.size
+	b.acking++
+	seq := b.acknowledgedSeq()
+	bulkQueueDepth.set(float64(b.pending))
+	b.m.Unlock()
+
+	b.al.Lock()
+	if seq > b.acked {
+		b.acked = seq
+		if b.OnAcknowledged != nil {
+			b.OnAcknowledged(seq)
+		}
+	}
+	b.al.Unlock()
+
+	b.m.Lock()
+	b.acking--
+	b.drained.Broadcast()
+	b.m.Unlock()
+}
+
+// Returns the number of the latest Add acknowledged along with every Add before it,
+// the one before the oldest Add with actions not yet acknowledged. Must be locked.
+func (b *Bulker) acknowledgedSeq() uint64 {
+	seq := b.added
+	for _, w := range b.workers {
+		var oldest *bulkBatch
+		if len(w.sent) > 0 {
+			oldest = w.sent[0]
+		} else if w.batch != nil {
+			oldest = w.batch
+		}
+		if oldest != nil && oldest.first-1 < seq {
+			seq = oldest.first - 1
+		}
+	}
+	return seq
+}
+
+// Returns the partition of the document the action applies to
+func (b *Bulker) partition(req elastic.BulkableRequest) int {
+	if len(b.workers) == 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(documentKey(req)))
+	return int(h.Sum32() % uint32(len(b.workers)))
+}
+
+// Returns the index and id of the document the action applies to, as given by
+// its action and metadata line
+func documentKey(req elastic.BulkableRequest) string {
+	lines, err := req.Source()
+	if err != nil || len(lines) == 0 {
+		return ""
+	}
+	var command map[string]struct {
+		Index string `json:"_index"`
+		Id    string `json:"_id"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &command); err != nil {
+		return ""
+	}
+	for _, meta := range command {
+		return meta.Index + "/" + meta.Id
+	}
+	return ""
+}
+
+func (batch *bulkBatch) add(req elastic.BulkableRequest, source *ActionSource) {
+	batch.service.Add(req)
+	batch.requests = append(batch.requests, req)
+	batch.sources = append(batch.sources, source)
+	batch.size++
+}
+
+// Sends the batch, retrying with backoff until every action is acknowledged or
+// dead-lettered
+func (b *Bulker) submit(batch *bulkBatch) error {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			backoff := retryBackoff(b.RetryBackoff, attempt)
+			log.Warnf("Retrying %d actions in %v (retry %d/%d)", batch.service.NumberOfActions(), backoff, attempt, b.MaxRetries)
+			time.Sleep(backoff)
+		}
+		retry, err := b.do(batch)
+		if err != nil {
+			if attempt < b.MaxRetries && retryableError(err) {
+				continue
+			}
+			if b.OnError != nil {
+				b.OnError(err)
+			}
+			return err
+		} else if retry == 0 {
+			return nil
+		} else if attempt >= b.MaxRetries {
+			err = errors.Errorf("%d actions still failing after %d retries", retry, b.MaxRetries)
+			if b.OnError != nil {
+				b.OnError(err)
 			}
+			return err
 		}
-		log.Errorf(buffer.String())
-		// show bulk errors but continue
-		//b.LastError = errors.Errorf("%v actions failed during bulk update", count)
-	} else {
+	}
+}
+
+// Sends the batch, then leaves the actions to retry, if any, in the batch.
+// Dead-letters the actions Elasticsearch rejects.
+func (b *Bulker) do(batch *bulkBatch) (int, error) {
+	size := batch.service.NumberOfActions()
+	bulkSentBytes.add(float64(batch.service.EstimatedSizeInBytes()))
+	start := time.Now()
+	res, err := batch.service.Do()
+	bulkDuration.observe(time.Since(start).Seconds())
+	if err != nil {
+		bulkFailures.add(1, bulkErrorType(err))
+		log.Errorf("Bulk update %d/%d failed due to %v: %+v", size, b.MaxActions, err, res)
+		return 0, err
+	}
+
+	requests, sources := batch.requests, batch.sources
+	batch.requests, batch.sources = nil, nil
+	if !res.Errors {
 		log.Debugf("Bulk update %d/%d succeeded", size, b.MaxActions)
+		return 0, nil
+	}
+
+	var rejected []*deadLetter
+	var failed []*elastic.BulkResponseItem
+	for i, item := range res.Items {
+		for op, result := range item {
+			if result.Status >= 200 && result.Status <= 299 {
+				continue
+			} else if op == "delete" && result.Status == http.StatusNotFound {
+				// already deleted
+				continue
+			} else if versionConflict(result) && i < len(requests) && externallyVersioned(requests[i]) {
+				// the document is newer, as when rows are replayed under external versioning
+				bulkVersionConflicts.add(1)
+				continue
+			}
+			bulkFailures.add(1, bulkItemErrorType(result))
+			failed = append(failed, result)
+			if i >= len(requests) {
+				continue
+			} else if retryableStatus(result.Status) {
+				batch.service.Add(requests[i])
+				batch.requests = append(batch.requests, requests[i])
+				batch.sources = append(batch.sources, sources[i])
+			} else {
+				rejected = append(rejected, newDeadLetter(requests[i], sources[i], result))
+			}
+		}
+	}
+	if len(failed) == 0 {
+		return 0, nil
+	}
+
+	var buffer bytes.Buffer
+	count := len(failed)
+	buffer.WriteString(fmt.Sprintf("%v actions failed in bulk update, %d to retry and %d rejected:\n",
+		count, batch.service.NumberOfActions(), len(rejected)))
+	for i, er := range failed {
+		buffer.WriteString(fmt.Sprintf("\t%v:%v\n", er, er.Error))
+		if i == 2 {
+			if count > 3 {
+				buffer.WriteString(fmt.Sprintf("\t...\n"))
+			}
+			break;
+		}
+	}
+	log.Error(buffer.String())
+	if b.OnError != nil {
+		b.OnError(errors.New(strings.TrimSpace(buffer.String())))
+	}
+	if len(rejected) > 0 {
+		if b.DeadLetters == nil {
+			log.Errorf("Dropping %d rejected actions since there is no dead-letter queue", len(rejected))
+		} else if err := b.DeadLetters.Write(rejected); err != nil {
+			// better to stop than lose them
+			return 0, errors.Annotate(err, "dead-lettering rejected actions")
+		}
+	}
+	return batch.service.NumberOfActions(), nil
+}
+
+// Returns the wait before a retry, doubling from initial up to MaxRetryBackoff
+func retryBackoff(initial time.Duration, attempt int) time.Duration {
+	backoff := initial
+	for i := 1; i < attempt && backoff < MaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > MaxRetryBackoff {
+		return MaxRetryBackoff
+	}
+	return backoff
+}
+
+// Whether a failed bulk request may succeed if sent again. Errors without a
+// response, like connection errors, may.
+func retryableError(err error) bool {
+	if e, ok := err.(*elastic.Error); ok {
+		return retryableStatus(e.Status)
+	}
+	return true
+}
+
+// Whether a request or action failing with the status may succeed if sent again,
+// such as when Elasticsearch is overloaded or unavailable
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Whether the action was rejected for having an older version than the document
+func versionConflict(item *elastic.BulkResponseItem) bool {
+	return item.Status == http.StatusConflict && item.Error != nil &&
+		item.Error.Type == "version_conflict_engine_exception"
+}
+
+// Whether the action carries an external version, as given by its action and
+// metadata line. Version conflicts of other actions are failures.
+func externallyVersioned(req elastic.BulkableRequest) bool {
+	lines, err := req.Source()
+	if err != nil || len(lines) == 0 {
+		return false
+	}
+	var command map[string]struct {
+		VersionType string `json:"_version_type"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &command); err != nil {
+		return false
+	}
+	for _, meta := range command {
+		return meta.VersionType == externalVersionType
+	}
+	return false
+}
+
+// Returns the Elasticsearch error type of a failed bulk request
+func bulkErrorType(err error) string {
+	if e, ok := err.(*elastic.Error); ok && e.Details != nil && len(e.Details.Type) > 0 {
+		return e.Details.Type
+	}
+	return "request"
+}
+
+// Returns the Elasticsearch error type of a failed bulk action
+func bulkItemErrorType(item *elastic.BulkResponseItem) string {
+	if item.Error != nil && len(item.Error.Type) > 0 {
+		return item.Error.Type
 	}
-	return b.LastError
+	return fmt.Sprintf("status_%d", item.Status)
 }
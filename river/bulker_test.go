@@ -1,9 +1,18 @@
 package river
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gopkg.in/olivere/elastic.v3"
 )
 
@@ -25,6 +34,11 @@ func TestBulker(t *testing.T) {
 	var maxBytes int64 = 5000
 
 	bulker := NewBulker(es.es, maxActions, maxBytes)
+	bulker.Workers = 1
+	bulker.FlushInterval = 0
+	acked := make(chan uint64, 10)
+	bulker.OnAcknowledged = func(seq uint64) { acked <- seq }
+	defer bulker.Close()
 	bulker.Add([]elastic.BulkableRequest{actions[0]})
 	es.refresh(bulkerIndex)
 
@@ -34,6 +48,7 @@ func TestBulker(t *testing.T) {
 
 	// adding maxActions should cause the first batch to be submitted
 	bulker.Add([]elastic.BulkableRequest{actions[1]})
+	assert.Equal(t, uint64(2), <-acked)
 	hits = es.refresh(bulkerIndex).searchMatchAll(bulkerIndex).TotalHits()
 	assert.Equal(t, int64(maxActions), hits, "bulker only submitted %v/%v actions", hits, maxActions)
 
@@ -51,3 +66,158 @@ func TestBulker(t *testing.T) {
 func insertAction(index string, typ string, id string) elastic.BulkableRequest {
 	return elastic.NewBulkIndexRequest().Index(index).Type(typ).Id(id).Doc(&testdoc{id})
 }
+
+func TestBulkerOrder(t *testing.T) {
+	s := newFakeBulkServer()
+	defer s.Close()
+	b := newFakeBulker(t, s)
+	b.Workers = 4
+	b.MaxActions = 1
+	defer b.Close()
+
+	// each version of a document is a batch of its own, sent in the order added
+	for i := 0; i < 10; i++ {
+		for _, id := range []string{"1", "2", "3"} {
+			req := elastic.NewBulkIndexRequest().Index("idx").Type("t1").Id(id).Doc(map[string]int{"v": i})
+			assert.Nil(t, b.Add([]elastic.BulkableRequest{req}))
+		}
+	}
+	assert.Nil(t, b.Submit())
+	assert.Equal(t, 30, s.requests())
+	assert.Equal(t, 0, b.Count())
+
+	versions := make(map[string][]string)
+	for _, body := range s.bodies {
+		lines := strings.Split(strings.TrimSpace(body), "\n")
+		require.Len(t, lines, 2)
+		id := documentKey(rawBulkRequest(lines))
+		versions[id] = append(versions[id], lines[1])
+	}
+	for _, id := range []string{"idx/1", "idx/2", "idx/3"} {
+		require.Len(t, versions[id], 10)
+		for i, doc := range versions[id] {
+			assert.Equal(t, fmt.Sprintf(`{"v":%d}`, i), doc)
+		}
+	}
+}
+
+func TestBulkerAcknowledgedSeq(t *testing.T) {
+	b := NewBulker(nil, 10, 1024)
+	w1, w2 := new(bulkWorker), new(bulkWorker)
+	b.workers = []*bulkWorker{w1, w2}
+	b.added = 7
+	assert.Equal(t, uint64(7), b.acknowledgedSeq())
+
+	// the oldest Add not acknowledged holds back the ones after it
+	w1.sent = []*bulkBatch{{first: 3}, {first: 6}}
+	w2.batch = &bulkBatch{first: 5}
+	assert.Equal(t, uint64(2), b.acknowledgedSeq())
+	w1.sent = w1.sent[1:]
+	assert.Equal(t, uint64(4), b.acknowledgedSeq())
+	w2.batch = nil
+	assert.Equal(t, uint64(5), b.acknowledgedSeq())
+}
+
+func TestBulkerBackpressure(t *testing.T) {
+	s := newFakeBulkServer()
+	s.release = make(chan struct{})
+	defer s.Close()
+	b := newFakeBulker(t, s)
+	b.MaxActions = 1
+	b.QueueSize = 1
+
+	// one batch in flight and one queued
+	assert.Nil(t, b.Add([]elastic.BulkableRequest{insertAction("idx", "t1", "1")}))
+	assert.Nil(t, b.Add([]elastic.BulkableRequest{insertAction("idx", "t1", "2")}))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	added := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		b.Add([]elastic.BulkableRequest{insertAction("idx", "t1", "3")})
+		close(added)
+	}()
+	select {
+	case <-added:
+		t.Fatal("Add didn't block while the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.release <- struct{}{}
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Add still blocked once a batch was sent")
+	}
+	wg.Wait()
+
+	close(s.release)
+	assert.Nil(t, b.Close())
+	assert.Equal(t, 3, s.requests())
+}
+
+func TestDocumentKey(t *testing.T) {
+	assert.Equal(t, "idx/1", documentKey(insertAction("idx", "t1", "1")))
+	assert.Equal(t, "idx/1", documentKey(elastic.NewBulkDeleteRequest().Index("idx").Type("t1").Id("1")))
+	assert.Equal(t, "idx/1", documentKey(elastic.NewBulkUpdateRequest().Index("idx").Type("t1").Id("1").
+		Doc(map[string]interface{}{"a": 1})))
+	assert.Equal(t, "", documentKey(rawBulkRequest{"not json"}))
+}
+
+func TestBulkerFlushInterval(t *testing.T) {
+	s := newFakeBulkServer()
+	defer s.Close()
+	b := newFakeBulker(t, s)
+	b.FlushInterval = 10 * time.Millisecond
+	acked := make(chan uint64, 10)
+	b.OnAcknowledged = func(seq uint64) { acked <- seq }
+	defer b.Close()
+
+	// sent well before the batch is full
+	assert.Nil(t, b.Add([]elastic.BulkableRequest{insertAction("idx", "t1", "1")}))
+	select {
+	case seq := <-acked:
+		assert.Equal(t, uint64(1), seq)
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch not flushed")
+	}
+	assert.Equal(t, 1, s.requests())
+}
+
+func TestBulkerVersionConflict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bulker")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead_letter.json")
+
+	s := newFakeBulkServer([]int{http.StatusConflict, http.StatusOK})
+	defer s.Close()
+	b := newFakeBulker(t, s)
+	b.DeadLetters = NewDeadLetterQueue(path)
+	var failed error
+	b.OnError = func(err error) { failed = err }
+	defer b.Close()
+
+	// an older version than the document's is neither retried nor dead-lettered
+	versioned := func(id string) elastic.BulkableRequest {
+		return insertAction("idx", "t1", id).(*elastic.BulkIndexRequest).Version(5).VersionType(externalVersionType)
+	}
+	b.Add([]elastic.BulkableRequest{versioned("1"), versioned("2")})
+	assert.Nil(t, b.Submit())
+	assert.Equal(t, 1, s.requests())
+	assert.Nil(t, failed)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// but a conflict without an external version is a failure
+	s.m.Lock()
+	s.statuses = append(s.statuses, []int{http.StatusConflict, http.StatusOK})
+	s.m.Unlock()
+	b.Add([]elastic.BulkableRequest{insertAction("idx", "t1", "1"), versioned("2")})
+	assert.Nil(t, b.Submit())
+	assert.NotNil(t, failed)
+	letters := readDeadLetters(t, path)
+	require.Len(t, letters, 1)
+	assert.Equal(t, http.StatusConflict, letters[0].Status)
+	assert.Contains(t, letters[0].Request[0], `"_id":"1"`)
+}
@@ -1,10 +1,15 @@
 package river
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/ehalpern/go-mysql/canal"
+	"github.com/ehalpern/go-mysql/mysql"
 	"github.com/ehalpern/go-mysql/schema"
 	"github.com/ehalpern/mysql2es/config"
 	"github.com/juju/errors"
@@ -19,6 +24,18 @@ var (
 
 const (
 	fieldTypeList = "list"
+
+	// representations of decimal fields, float by default
+	fieldTypeString      = "string"
+	fieldTypeFloat       = "float"
+	fieldTypeScaledFloat = "scaled_float"
+
+	// representations of spatial fields, geo_point for POINT columns by default and
+	// geo_shape for others
+	fieldTypeGeoPoint = "geo_point"
+	fieldTypeGeoShape = "geo_shape"
+
+	externalVersionType = "external"
 )
 
 // Converts database replication row events to elasticsearch bulk actions
@@ -27,10 +44,33 @@ func Convert(rules *config.Runtime, e *canal.RowsEvent) ([]elastic.BulkableReque
 	if rule == nil {
 		return nil, errors.Errorf("no rule found for %s.%s", e.Table.Schema, e.Table.Name )
 	}
+	return convertEvent(rule, e, 0)
+}
+
+// Converts an event for a new version of the rule's index being filled by a
+// reindex. Updates are written as whole documents since the resnapshot may not
+// have read the rows being updated yet.
+func convertReindex(rule *config.Rule, index string, e *canal.RowsEvent, first int) ([]elastic.BulkableRequest, error) {
+	target := *rule
+	target.Index = index
+	if e.Action != canal.UpdateAction {
+		return convertEvent(&target, e, first)
+	}
+	reqs, err := convertUpsert(&target, e.Rows)
+	if err != nil {
+		return nil, errors.Errorf("Error adding %s to bulk request: %v", e.Action, err)
+	}
+	setExternalVersion(reqs, externalVersion(rule, e, first), e.Size > 0)
+	return reqs, nil
+}
 
+// Converts the event's rows, which start at row first of the binlog event they
+// were read from
+func convertEvent(rule *config.Rule, e *canal.RowsEvent, first int) ([]elastic.BulkableRequest, error) {
 	log.Debugf("Converting %v", rule)
 	var reqs []elastic.BulkableRequest
 	var err error
+	version := externalVersion(rule, e, first)
 
 	switch e.Action {
 	case canal.InsertAction:
@@ -38,6 +78,11 @@ func Convert(rules *config.Runtime, e *canal.RowsEvent) ([]elastic.BulkableReque
 	case canal.DeleteAction:
 		reqs, err = convertDelete(rule, e.Rows)
 	case canal.UpdateAction:
+		if version > 0 {
+			// partial updates can't be versioned
+			reqs, err = convertUpsert(rule, e.Rows)
+			break
+		}
 		log.Debugf("Converting update: %+v", e.Rows)
 		reqs, err = convertUpdate(rule, e.Rows)
 		log.Debugf("Converted update: %+v", reqs)
@@ -49,9 +94,62 @@ func Convert(rules *config.Runtime, e *canal.RowsEvent) ([]elastic.BulkableReque
 		return nil, errors.Errorf("Error adding %s to bulk request: %v", e.Action, err)
 	}
 
+	setExternalVersion(reqs, version, e.Size > 0)
 	return reqs, nil
 }
 
+// Returns the external version of the first action converted from the event's
+// rows, which start at row first of the binlog event, if the rule uses external
+// versioning, or 0. The actions of a binlog event are versioned from the position
+// after its start, one per row or action of a row, so that two actions on one
+// document, as when an update shifts keys, are ordered. They stay at or below the
+// position following the event, since every row takes at least a byte. Snapshot
+// rows are all versioned by the position they're consistent with.
+func externalVersion(rule *config.Rule, e *canal.RowsEvent, first int) int64 {
+	if !rule.ExternalVersion {
+		return 0
+	}
+	version := binlogVersion(e.Position)
+	if version == 0 || e.Size == 0 {
+		return version
+	}
+	return version - int64(e.Size) + 1 + int64(first)
+}
+
+// Returns a version that increases through the binlog: the sequence number of the
+// binlog file in the high bits and the position within it in the low bits. 0 if
+// pos doesn't identify a position in a numbered binlog file.
+func binlogVersion(pos mysql.Position) int64 {
+	i := strings.LastIndex(pos.Name, ".")
+	if i < 0 || pos.Pos == 0 {
+		return 0
+	}
+	seq, err := strconv.ParseUint(pos.Name[i+1:], 10, 31)
+	if err != nil {
+		return 0
+	}
+	return int64(seq)<<32 | int64(pos.Pos)
+}
+
+// Sends the index and delete requests with the external version, unless 0, or with
+// consecutive versions from it if each action must have its own
+func setExternalVersion(reqs []elastic.BulkableRequest, version int64, consecutive bool) {
+	if version == 0 {
+		return
+	}
+	for _, req := range reqs {
+		switch req := req.(type) {
+		case *elastic.BulkIndexRequest:
+			req.Version(version).VersionType(externalVersionType)
+		case *elastic.BulkDeleteRequest:
+			req.Version(version).VersionType(externalVersionType)
+		}
+		if consecutive {
+			version++
+		}
+	}
+}
+
 // for insert and delete
 func convertAction(rule *config.Rule, action string, rows [][]interface{}) ([]elastic.BulkableRequest, error) {
 	reqs := make([]elastic.BulkableRequest, 0, len(rows))
@@ -92,7 +190,6 @@ func convertUpdate(rule *config.Rule, rows [][]interface{}) ([]elastic.BulkableR
 	}
 
 	reqs := make([]elastic.BulkableRequest, 0, len(rows))
-	var err error = nil
 
 	for i := 0; i < len(rows); i += 2 {
 		beforeID, err := rule.DocId(rows[i])
@@ -117,28 +214,75 @@ func convertUpdate(rule *config.Rule, rows [][]interface{}) ([]elastic.BulkableR
 			return nil, errors.Trace(err)
 		}
 
-		var req elastic.BulkableRequest
-		req = elastic.NewBulkUpdateRequest().Index(rule.Index).Type(rule.Type).Parent(beforeParentID).Id(beforeID).Routing(beforeParentID)
-
 		if beforeID != afterID || beforeParentID != afterParentID {
-			// if an id is changing, delete the old document and insert a new one
-			req = elastic.NewBulkDeleteRequest().Index(rule.Index).Type(rule.Type).Id(beforeID).Routing(beforeParentID)
+			// if any PK column or the parent is changing, the document moves: delete
+			// the old document and insert a new one
+			req := elastic.NewBulkDeleteRequest().Index(rule.Index).Type(rule.Type).Id(beforeID).Routing(beforeParentID)
 			reqs = append(reqs, req)
-			temp, err := convertInsert(rule, [][]interface{}{rows[i+1]})
-			if err == nil {
-				req = temp[0]
+			inserts, err := convertInsert(rule, rows[i+1:i+2])
+			if err != nil {
+				return nil, errors.Trace(err)
 			}
+			reqs = append(reqs, inserts...)
 		} else {
 			doc := convertUpdateRow(rule, rows[i], rows[i+1])
-			req = elastic.NewBulkUpdateRequest().Index(rule.Index).Type(rule.Type).Parent(beforeParentID).Id(beforeID).Routing(beforeParentID).Doc(doc)
+			req := elastic.NewBulkUpdateRequest().Index(rule.Index).Type(rule.Type).Parent(beforeParentID).Id(beforeID).Routing(beforeParentID).Doc(doc)
+			reqs = append(reqs, req)
+		}
+	}
+
+	return reqs, nil
+}
+
+// Converts updates into deletes of documents whose id changed and index requests
+// replacing the whole document
+func convertUpsert(rule *config.Rule, rows [][]interface{}) ([]elastic.BulkableRequest, error) {
+	if len(rows) % 2 != 0 {
+		return nil, errors.Errorf("invalid update rows event, must have 2x rows, but %d", len(rows))
+	}
+
+	reqs := make([]elastic.BulkableRequest, 0, len(rows))
+
+	for i := 0; i < len(rows); i += 2 {
+		beforeID, err := rule.DocId(rows[i])
+		if err != nil {
+			log.Warnf("skipping row update due to problem with before update values: %v\n", err)
+			continue
+		}
+		afterID, err := rule.DocId(rows[i+1])
+		if err != nil {
+			log.Warnf("skipping row update due to problem with update values: %v\n", err)
+			continue
+		}
+
+		beforeParentID, err := rule.ParentId(rows[i])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		afterParentID, err := rule.ParentId(rows[i+1])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if beforeID != afterID || beforeParentID != afterParentID {
+			req := elastic.NewBulkDeleteRequest().Index(rule.Index).Type(rule.Type).Id(beforeID).Routing(beforeParentID)
+			reqs = append(reqs, req)
+		}
+		inserts, err := convertInsert(rule, rows[i+1:i+2])
+		if err != nil {
+			return nil, errors.Trace(err)
 		}
-		reqs = append(reqs, req)
+		reqs = append(reqs, inserts...)
 	}
 
-	return reqs, err
+	return reqs, nil
 }
 
-func convertColumnData(col *schema.TableColumn, value interface{}) interface{} {
+// Converts a column value to the value sent to Elasticsearch. Dump and snapshot
+// rows are read into the types binlog rows carry where they can be, e.g. temporal
+// values as strings and decimals as exact strings, so a column's value converts
+// the same whichever of the three it comes from.
+func convertColumnData(col *schema.TableColumn, value interface{}, tc *config.TimeConversion) interface{} {
 	switch col.Type {
 	case schema.TYPE_ENUM:
 		switch value := value.(type) {
@@ -174,11 +318,74 @@ func convertColumnData(col *schema.TableColumn, value interface{}) interface{} {
 		switch value := value.(type) {
 		case int64:
 			return float64(value)
+		case string:
+			// a decimal column of a table whose schema was recorded before decimals
+			// had their own type, or a dumped value
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				return f
+			}
+		}
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP, schema.TYPE_DATE, schema.TYPE_TIME:
+		return convertTemporal(tc, col, value)
+	case schema.TYPE_JSON:
+		return convertJSON(col, value)
+	case schema.TYPE_BIT:
+		return convertBit(col, value)
+	case schema.TYPE_BINARY:
+		// base64, as Elasticsearch's binary type expects
+		switch value := value.(type) {
+		case []byte:
+			return base64.StdEncoding.EncodeToString(value)
+		case string:
+			return base64.StdEncoding.EncodeToString([]byte(value))
 		}
 	}
 	return value
 }
 
+// Parses the text of a JSON column into the object, array or scalar it holds.
+// Numbers are kept as they're written.
+func convertJSON(col *schema.TableColumn, value interface{}) interface{} {
+	var data []byte
+	switch value := value.(type) {
+	case string:
+		data = []byte(value)
+	case []byte:
+		data = value
+	default:
+		return value
+	}
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		log.Warnf("Sending invalid JSON of column %s as a string: %v", col.Name, err)
+		return string(data)
+	}
+	return v
+}
+
+// Converts a BIT(1) to a boolean, and wider bits to a string of their binary digits
+// such as "00000101" for a BIT(8)
+func convertBit(col *schema.TableColumn, value interface{}) interface{} {
+	var n uint64
+	switch value := value.(type) {
+	case int64:
+		n = uint64(value)
+	case uint64:
+		n = value
+	default:
+		return value
+	}
+	if col.Precision <= 1 {
+		return n != 0
+	}
+	s := strconv.FormatUint(n, 2)
+	if len(s) < col.Precision {
+		s = strings.Repeat("0", col.Precision-len(s)) + s
+	}
+	return s
+}
 
 func convertRow(rule *config.Rule, values []interface{}) map[string]interface{} {
 	doc := make(map[string]interface{}, len(values))
@@ -194,9 +401,9 @@ func convertUpdateRow(rule *config.Rule, before []interface{}, after []interface
 	doc := make(map[string]interface{}, len(after))
 	for i, c := range rule.TableInfo.Columns {
 		if len(after) <= i {
-			// New column may have been to schema before update was processed. This is due
-			// to design flaw in go-mysql that reads most recent schema when restarting
-			// replication rather than updating schema based on replication log contents.
+			// New column may have been added to schema before update was processed. Canal
+			// keeps a schema history so this only happens for tables first loaded after
+			// the change, whose definition can only be read from the live server.
 			break;
 		}
 		if len(before) <= i || !reflect.DeepEqual(before[i], after[i]) {
@@ -209,21 +416,19 @@ func convertUpdateRow(rule *config.Rule, before []interface{}, after []interface
 }
 
 func convertField(rule *config.Rule, column *schema.TableColumn, value interface{}) (string, interface{}) {
-	v := convertColumnData(column, value)
-	for cname, s := range rule.FieldMapping {
-		if cname == column.Name {
-			fname, ftype := parseFieldMapping(cname, s)
-			str, ok := v.(string)
-			if ok == false {
-				return cname, v
-			} else if ftype == fieldTypeList {
-				return fname, strings.Split(str, ",")
-			} else {
-				return fname, str
-			}
-		}
+	v := convertColumnData(column, value, rule.TimeConversion)
+	fname, ftype := column.Name, ""
+	if s, ok := rule.FieldMapping[column.Name]; ok {
+		fname, ftype = parseFieldMapping(column.Name, s)
+	}
+	if column.Type == schema.TYPE_DECIMAL {
+		return fname, convertDecimal(column, v, ftype)
+	} else if _, ok := v.(*mysql.Geometry); ok || column.Type == schema.TYPE_GEOMETRY {
+		return fname, convertGeometry(column, v, ftype)
+	} else if str, ok := v.(string); ok && ftype == fieldTypeList {
+		return fname, strings.Split(str, ",")
 	}
-	return column.Name, v
+	return fname, v
 }
 
 func parseFieldMapping(cname string, value string) (string, string) {
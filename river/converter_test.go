@@ -0,0 +1,298 @@
+package river
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ehalpern/go-mysql/canal"
+	"github.com/ehalpern/go-mysql/mysql"
+	"github.com/ehalpern/go-mysql/schema"
+	"github.com/ehalpern/mysql2es/config"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+func compositeRule() *config.Rule {
+	rule := config.NewDefaultRule("test", "composite")
+	rule.TableInfo = &schema.Table{Schema: "test", Name: "composite"}
+	rule.TableInfo.AddColumn("tenant", "int(11)", "")
+	rule.TableInfo.AddColumn("id", "int(11)", "")
+	rule.TableInfo.AddColumn("title", "varchar(256)", "")
+	rule.TableInfo.AddIndexWithColumns("PRIMARY", "tenant", "id")
+	return rule
+}
+
+func TestConvertCompositeUpdate(t *testing.T) {
+	rule := compositeRule()
+
+	// Update of a non-key column updates the document in place
+	reqs, err := convertUpdate(rule, [][]interface{}{
+		{int64(1), int64(2), "before"},
+		{int64(1), int64(2), "after"},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, reqs, 1)
+	update, ok := reqs[0].(*elastic.BulkUpdateRequest)
+	assert.True(t, ok)
+	assert.Contains(t, update.String(), `"_id":"1:2"`)
+
+	// Changing one component of the key moves the document
+	reqs, err = convertUpdate(rule, [][]interface{}{
+		{int64(1), int64(2), "before"},
+		{int64(3), int64(2), "before"},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, reqs, 2)
+	del, ok := reqs[0].(*elastic.BulkDeleteRequest)
+	assert.True(t, ok)
+	assert.Contains(t, del.String(), `"_id":"1:2"`)
+	index, ok := reqs[1].(*elastic.BulkIndexRequest)
+	assert.True(t, ok)
+	assert.Contains(t, index.String(), `"_id":"3:2"`)
+	assert.Contains(t, index.String(), `"title":"before"`)
+}
+
+func TestConvertExternalVersion(t *testing.T) {
+	rule := compositeRule()
+	pos := mysql.Position{Name: "mysql-bin.000003", Pos: 1234}
+	e := &canal.RowsEvent{Table: rule.TableInfo, Action: canal.UpdateAction, Position: pos, Rows: [][]interface{}{
+		{int64(1), int64(2), "before"},
+		{int64(1), int64(2), "after"},
+	}}
+
+	// not unless the rule asks for it
+	reqs, err := convertEvent(rule, e, 0)
+	assert.Nil(t, err)
+	assert.NotContains(t, reqs[0].String(), `"_version"`)
+
+	// updates are sent as whole documents so they can be versioned
+	rule.ExternalVersion = true
+	reqs, err = convertEvent(rule, e, 0)
+	assert.Nil(t, err)
+	assert.Len(t, reqs, 1)
+	index, ok := reqs[0].(*elastic.BulkIndexRequest)
+	assert.True(t, ok)
+	assert.Contains(t, index.String(), `"_version":12884903122`)
+	assert.Contains(t, index.String(), `"_version_type":"external"`)
+	assert.Contains(t, index.String(), `"title":"after"`)
+
+	e.Action = canal.DeleteAction
+	e.Rows = e.Rows[:1]
+	reqs, err = convertEvent(rule, e, 0)
+	assert.Nil(t, err)
+	assert.Contains(t, reqs[0].String(), `"_version":12884903122`)
+
+	// versions increase through the binlog
+	assert.True(t, binlogVersion(mysql.Position{Name: "mysql-bin.000003", Pos: 4}) > binlogVersion(mysql.Position{Name: "mysql-bin.000002", Pos: 1 << 31}))
+	assert.True(t, binlogVersion(pos) > binlogVersion(mysql.Position{Name: "mysql-bin.000003", Pos: 1233}))
+	assert.Equal(t, int64(0), binlogVersion(mysql.Position{}))
+	assert.Equal(t, int64(0), binlogVersion(mysql.Position{Name: "unnumbered", Pos: 4}))
+}
+
+// Returns the id and external version of an action
+func actionVersion(t *testing.T, req elastic.BulkableRequest) (string, int64) {
+	lines, err := req.Source()
+	assert.Nil(t, err)
+	var command map[string]struct {
+		Id      string `json:"_id"`
+		Version int64  `json:"_version"`
+	}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &command))
+	for _, meta := range command {
+		return meta.Id, meta.Version
+	}
+	return "", 0
+}
+
+func TestConvertExternalVersionKeyShift(t *testing.T) {
+	rule := compositeRule()
+	rule.ExternalVersion = true
+	// UPDATE composite SET id = id + 1 ORDER BY id DESC
+	pos := mysql.Position{Name: "mysql-bin.000003", Pos: 1234}
+	e := &canal.RowsEvent{Table: rule.TableInfo, Action: canal.UpdateAction, Position: pos, Size: 100,
+		Rows: [][]interface{}{
+			{int64(1), int64(2), "b"}, {int64(1), int64(3), "b"},
+			{int64(1), int64(1), "a"}, {int64(1), int64(2), "a"},
+		}}
+
+	// converted whole, and a row at a time as the syncer does
+	var grouped []elastic.BulkableRequest
+	first := 0
+	for _, rows := range rowGroups(e) {
+		re := *e
+		re.Rows = rows
+		reqs, err := convertEvent(rule, &re, first)
+		assert.Nil(t, err)
+		grouped = append(grouped, reqs...)
+		first += len(rows)
+	}
+	whole, err := convertEvent(rule, e, 0)
+	assert.Nil(t, err)
+
+	for _, reqs := range [][]elastic.BulkableRequest{whole, grouped} {
+		assert.Len(t, reqs, 4)
+		versions := make(map[int64]bool)
+		var deleted, indexed int64
+		for _, req := range reqs {
+			id, version := actionVersion(t, req)
+			assert.False(t, versions[version], "version %d repeated", version)
+			versions[version] = true
+			// after the previous event, and no later than the next
+			assert.True(t, version > binlogVersion(mysql.Position{Name: pos.Name, Pos: pos.Pos - 100}))
+			assert.True(t, version <= binlogVersion(pos))
+			if id == "1:2" {
+				if _, ok := req.(*elastic.BulkDeleteRequest); ok {
+					deleted = version
+				} else {
+					indexed = version
+				}
+			}
+		}
+		// the row moved to 1:2 is newer than the one moved from it
+		assert.True(t, deleted > 0 && indexed > deleted)
+	}
+}
+
+func TestConvertTemporal(t *testing.T) {
+	rule := config.NewDefaultRule("test", "temporal")
+	rule.TableInfo = &schema.Table{Schema: "test", Name: "temporal"}
+	rule.TableInfo.AddColumn("dt", "datetime(3)", "")
+	rule.TableInfo.AddColumn("ts", "timestamp", "")
+	rule.TableInfo.AddColumn("d", "date", "")
+	rule.TableInfo.AddColumn("tm", "time(2)", "")
+
+	// datetimes are in UTC unless configured, timestamps always are
+	doc := convertRow(rule, []interface{}{"2020-01-02 03:04:05.123", "2020-01-02 03:04:05", "2020-01-02", "-12:34:56.78"})
+	assert.Equal(t, map[string]interface{}{"dt": "2020-01-02T03:04:05.123Z", "ts": "2020-01-02T03:04:05Z",
+		"d": "2020-01-02", "tm": "-12:34:56.78"}, doc)
+
+	// snapshots have the full 6 digits, dumps may have fewer
+	doc = convertRow(rule, []interface{}{"2020-01-02 03:04:05.123456", "2020-01-02 03:04:05.000000", []byte("2020-01-02"), "12:34:56.5"})
+	assert.Equal(t, map[string]interface{}{"dt": "2020-01-02T03:04:05.123Z", "ts": "2020-01-02T03:04:05Z",
+		"d": "2020-01-02", "tm": "12:34:56.50"}, doc)
+
+	tc := *config.DefaultTimeConversion
+	rule.TimeConversion = &tc
+	tc.Location, _ = time.LoadLocation("America/New_York")
+	tc.Precision = 0
+	doc = convertRow(rule, []interface{}{"2020-01-02 03:04:05.999", "2020-01-02 03:04:05", "2020-01-02", "12:34:56.78"})
+	assert.Equal(t, map[string]interface{}{"dt": "2020-01-02T08:04:05Z", "ts": "2020-01-02T03:04:05Z",
+		"d": "2020-01-02", "tm": "12:34:56"}, doc)
+
+	// zero dates
+	zeros := []interface{}{"0000-00-00 00:00:00", "0000-00-00 00:00:00", "2020-00-00", nil}
+	tc.Precision = -1
+	assert.Equal(t, map[string]interface{}{"dt": nil, "ts": nil, "d": nil, "tm": nil}, convertRow(rule, zeros))
+	tc.ZeroDate = config.ZeroDateKeep
+	assert.Equal(t, map[string]interface{}{"dt": "0000-00-00 00:00:00", "ts": "0000-00-00 00:00:00",
+		"d": "2020-00-00", "tm": nil}, convertRow(rule, zeros))
+	tc.ZeroDate = config.ZeroDateEpoch
+	assert.Equal(t, map[string]interface{}{"dt": "1970-01-01T00:00:00.000Z", "ts": "1970-01-01T00:00:00Z",
+		"d": "1970-01-01", "tm": nil}, convertRow(rule, zeros))
+}
+
+func TestConvertJSON(t *testing.T) {
+	rule := config.NewDefaultRule("test", "json")
+	rule.TableInfo = &schema.Table{Schema: "test", Name: "json"}
+	rule.TableInfo.AddColumn("id", "int(11)", "")
+	rule.TableInfo.AddColumn("attrs", "json", "")
+	rule.FieldMapping["attrs"] = "attributes"
+
+	// the binlog has the text as bytes, snapshots and dumps as strings
+	big := json.Number("18446744073709551615")
+	doc := convertRow(rule, []interface{}{int64(1), []byte(`{"tags":["a","b"],"n":18446744073709551615,"ok":true}`)})
+	assert.Equal(t, map[string]interface{}{"id": int64(1), "attributes": map[string]interface{}{
+		"tags": []interface{}{"a", "b"}, "n": big, "ok": true}}, doc)
+	doc = convertRow(rule, []interface{}{int64(1), `[1.50, null]`})
+	assert.Equal(t, []interface{}{json.Number("1.50"), nil}, doc["attributes"])
+	doc = convertRow(rule, []interface{}{int64(1), nil})
+	assert.Nil(t, doc["attributes"])
+
+	// invalid JSON is sent as is
+	doc = convertRow(rule, []interface{}{int64(1), `{"a":`})
+	assert.Equal(t, `{"a":`, doc["attributes"])
+
+	req := elastic.NewBulkIndexRequest().Index("json").Type("json").Id("1").Doc(convertRow(rule, []interface{}{int64(1), `{"n":18446744073709551615}`}))
+	assert.Contains(t, req.String(), `"attributes":{"n":18446744073709551615}`)
+}
+
+func TestConvertDecimal(t *testing.T) {
+	rule := config.NewDefaultRule("test", "decimal")
+	rule.TableInfo = &schema.Table{Schema: "test", Name: "decimal"}
+	rule.TableInfo.AddColumn("f", "decimal(10,2)", "")
+	rule.TableInfo.AddColumn("s", "decimal(30,20)", "")
+	rule.TableInfo.AddColumn("n", "decimal(10,2)", "")
+	rule.FieldMapping["s"] = ",string"
+	rule.FieldMapping["n"] = "cents,scaled_float"
+
+	// floats by default, the binlog and snapshots have exact strings
+	doc := convertRow(rule, []interface{}{"12.50", "0.01234567890123456789", "-12.50"})
+	assert.Equal(t, map[string]interface{}{"f": 12.5, "s": "0.01234567890123456789", "cents": int64(-1250)}, doc)
+
+	// dumps may have fewer digits
+	doc = convertRow(rule, []interface{}{[]byte("3"), "-0001.5", "0.001"})
+	assert.Equal(t, map[string]interface{}{"f": float64(3), "s": "-1.50000000000000000000", "cents": int64(0)}, doc)
+
+	doc = convertRow(rule, []interface{}{nil, "x", nil})
+	assert.Equal(t, map[string]interface{}{"f": nil, "s": "x", "cents": nil}, doc)
+
+	rule.FieldMapping["s"] = ",scaled_float"
+	doc = convertRow(rule, []interface{}{"1", "123456789.01234567890123456789", "1"})
+	assert.Equal(t, json.Number("12345678901234567890123456789"), doc["s"])
+}
+
+func TestConvertBitAndBinary(t *testing.T) {
+	rule := config.NewDefaultRule("test", "binary")
+	rule.TableInfo = &schema.Table{Schema: "test", Name: "binary"}
+	rule.TableInfo.AddColumn("id", "bigint(20) unsigned", "")
+	rule.TableInfo.AddColumn("flag", "bit(1)", "")
+	rule.TableInfo.AddColumn("mask", "bit(10)", "")
+	rule.TableInfo.AddColumn("data", "blob", "")
+
+	doc := convertRow(rule, []interface{}{uint64(18446744073709551615), int64(1), int64(5), []byte{0x00, 0xff, 'a'}})
+	assert.Equal(t, map[string]interface{}{"id": uint64(18446744073709551615), "flag": true,
+		"mask": "0000000101", "data": "AP9h"}, doc)
+
+	doc = convertRow(rule, []interface{}{uint64(1), uint64(0), uint64(1023), ""})
+	assert.Equal(t, map[string]interface{}{"id": uint64(1), "flag": false, "mask": "1111111111", "data": ""}, doc)
+
+	doc = convertRow(rule, []interface{}{uint64(1), nil, nil, nil})
+	assert.Equal(t, map[string]interface{}{"id": uint64(1), "flag": nil, "mask": nil, "data": nil}, doc)
+}
+
+func TestConvertGeometry(t *testing.T) {
+	rule := config.NewDefaultRule("test", "geometry")
+	rule.TableInfo = &schema.Table{Schema: "test", Name: "geometry"}
+	rule.TableInfo.AddColumn("location", "point", "")
+	rule.TableInfo.AddColumn("area", "geometry", "")
+	rule.TableInfo.AddColumn("shape", "point", "")
+	rule.FieldMapping["shape"] = ",geo_shape"
+
+	point := &mysql.Geometry{SRID: 4326, Type: "Point", Coordinates: []float64{-73.5, 40.25}}
+	line := &mysql.Geometry{Type: "LineString", Coordinates: [][]float64{{0, 0}, {1, 1}}}
+	doc := convertRow(rule, []interface{}{point, line, point})
+	assert.Equal(t, map[string]interface{}{
+		"location": map[string]interface{}{"lat": 40.25, "lon": -73.5},
+		"area":     map[string]interface{}{"type": "LineString", "coordinates": [][]float64{{0, 0}, {1, 1}}},
+		"shape":    map[string]interface{}{"type": "Point", "coordinates": []float64{-73.5, 40.25}},
+	}, doc)
+
+	// collections, and bytes as mydumper dumps have them
+	collection := &mysql.Geometry{Type: "GeometryCollection", Geometries: []*mysql.Geometry{point, line}}
+	wkb := []byte{0, 0, 0, 0, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, 0, 0, 0, 0, 0, 0, 0, 0x40}
+	doc = convertRow(rule, []interface{}{wkb, collection, nil})
+	assert.Equal(t, map[string]interface{}{
+		"location": map[string]interface{}{"lat": float64(2), "lon": float64(1)},
+		"area": map[string]interface{}{"type": "GeometryCollection", "geometries": []interface{}{
+			map[string]interface{}{"type": "Point", "coordinates": []float64{-73.5, 40.25}},
+			map[string]interface{}{"type": "LineString", "coordinates": [][]float64{{0, 0}, {1, 1}}},
+		}},
+		"shape": nil,
+	}, doc)
+
+	// only points are geo_points, and invalid values are sent as null
+	rule.FieldMapping["area"] = ",geo_point"
+	doc = convertRow(rule, []interface{}{"invalid", line, nil})
+	assert.Equal(t, map[string]interface{}{"location": nil, "area": nil, "shape": nil}, doc)
+}
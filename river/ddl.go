@@ -0,0 +1,149 @@
+package river
+
+import (
+	"io"
+	"strings"
+
+	"github.com/ehalpern/go-mysql/canal"
+	"github.com/ehalpern/mysql2es/config"
+	"github.com/siddontang/go/log"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+const deleteScrollSize = 1000
+
+// Keeps the rules and indexes in step with tables being created, dropped,
+// truncated or renamed
+func (s *syncer) DoTable(e *canal.TableEvent) error {
+	var err error
+	switch e.Action {
+	case canal.CreateAction:
+		err = s.addTable(e.Schema, e.Table)
+	case canal.RenameAction:
+		if rule := s.rules.RenameRule(e.Schema, e.Table, e.NewSchema, e.NewTable, e.Replaced); rule != nil {
+			log.Infof("Syncing %s.%s into %s/%s after rename from %s.%s", e.NewSchema, e.NewTable,
+				rule.Index, rule.Type, e.Schema, e.Table)
+		} else {
+			// the table had no rule to move, kept its rule for the table replacing it,
+			// or was renamed to a name with a rule of its own
+			err = s.addTable(e.NewSchema, e.NewTable)
+		}
+	case canal.TruncateAction:
+		if rule := s.rules.GetRule(e.Schema, e.Table); rule != nil {
+			err = s.deleteDocuments(rule)
+		}
+	case canal.DropAction:
+		if rule := s.rules.RemoveRule(e.Schema, e.Table); rule != nil {
+			log.Infof("Stopped syncing dropped table %s.%s", e.Schema, e.Table)
+			switch rule.OnDrop {
+			case config.OnDropDelete:
+				err = s.deleteDocuments(rule)
+			case config.OnDropDeleteIndex:
+				err = s.deleteIndex(rule)
+			}
+		}
+	}
+	if err != nil {
+		log.Errorf("Handler failing on %v due to %v", e, err)
+		return canal.ErrHandleInterrupted
+	}
+	return nil
+}
+
+func (s *syncer) addTable(schema string, table string) error {
+	rule, err := s.rules.AddTable(schema, table)
+	if err != nil {
+		// same as at startup, but there's no need to stop syncing everything else
+		log.Errorf("Not syncing new table %s.%s: %v", schema, table, err)
+		return nil
+	} else if rule == nil {
+		return nil
+	}
+	return s.river.createRuleIndex(rule)
+}
+
+// Deletes every document synced from the rule's table. Documents don't record
+// the table they came from, so this is only possible when no other table is
+// synced into the same index and type.
+func (s *syncer) deleteDocuments(rule *config.Rule) error {
+	for _, other := range s.rules.IndexRules(rule.Index) {
+		if other != rule && other.Type == rule.Type {
+			log.Warnf("Not deleting documents of %s.%s since %s/%s also holds documents of %s.%s",
+				rule.Schema, rule.Table, rule.Index, rule.Type, other.Schema, other.Table)
+			return nil
+		}
+	}
+
+	log.Infof("Deleting documents of %s.%s from %s/%s", rule.Schema, rule.Table, rule.Index, rule.Type)
+	source := elastic.NewSearchSource().Query(elastic.NewMatchAllQuery()).
+		FetchSource(false).Fields("_routing", "_parent")
+	scroll := s.river.es.Scroll(rule.Index).Type(rule.Type).Size(deleteScrollSize).SearchSource(source)
+	for {
+		res, err := scroll.Do()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		reqs := make([]elastic.BulkableRequest, 0, len(res.Hits.Hits))
+		for _, hit := range res.Hits.Hits {
+			req := elastic.NewBulkDeleteRequest().Index(hit.Index).Type(hit.Type).Id(hit.Id)
+			if routing := hitRouting(hit); len(routing) > 0 {
+				req.Routing(routing)
+			}
+			reqs = append(reqs, req)
+		}
+		if err := s.bulker.Add(reqs); err != nil {
+			return err
+		}
+	}
+	return s.bulker.Submit()
+}
+
+// Returns the routing needed to delete a child document
+func hitRouting(hit *elastic.SearchHit) string {
+	if len(hit.Routing) > 0 {
+		return hit.Routing
+	} else if len(hit.Parent) > 0 {
+		return hit.Parent
+	}
+	for _, field := range []string{"_routing", "_parent"} {
+		if value, ok := hit.Fields[field].(string); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// Deletes the rule's index unless other tables are still synced into it
+func (s *syncer) deleteIndex(rule *config.Rule) error {
+	for _, other := range s.rules.IndexRules(rule.Index) {
+		if other != rule {
+			log.Warnf("Not deleting index %s since it also holds documents of %s.%s",
+				rule.Index, other.Schema, other.Table)
+			return nil
+		}
+	}
+
+	indexes := []string{rule.Index}
+	if rule.Versions > 0 {
+		// deleting every version deletes the alias too
+		_, versions, err := s.river.aliasVersions(rule.Index)
+		if err != nil {
+			return err
+		}
+		indexes = indexes[:0]
+		for _, v := range versions {
+			indexes = append(indexes, versionedIndex(rule.Index, v))
+		}
+		if len(indexes) == 0 {
+			return nil
+		}
+	}
+
+	log.Infof("Deleting index %s of dropped table %s.%s", strings.Join(indexes, ", "), rule.Schema, rule.Table)
+	if _, err := s.river.es.DeleteIndex(indexes...).Do(); err != nil && !elastic.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
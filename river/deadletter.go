@@ -0,0 +1,194 @@
+package river
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ehalpern/go-mysql/canal"
+	"github.com/ehalpern/mysql2es/config"
+	"github.com/juju/errors"
+	"github.com/siddontang/go/log"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// Identifies the row an action was converted from, and where it was read in the
+// binlog, so a dead-lettered action can be traced back to the source
+type ActionSource struct {
+	Schema     string        `json:"schema"`
+	Table      string        `json:"table"`
+	Action     string        `json:"action"`
+	Row        []interface{} `json:"row"`
+	BinlogName string        `json:"binlog_name,omitempty"`
+	BinlogPos  uint32        `json:"binlog_pos,omitempty"`
+}
+
+// Returns the source of the actions converted from rows of the event. Updates
+// have the row's before and after images.
+func newActionSource(e *canal.RowsEvent, rows [][]interface{}) *ActionSource {
+	s := &ActionSource{
+		Schema:     e.Table.Schema,
+		Table:      e.Table.Name,
+		Action:     e.Action,
+		BinlogName: e.Position.Name,
+		BinlogPos:  e.Position.Pos,
+	}
+	for _, row := range rows {
+		for _, v := range row {
+			if b, ok := v.([]byte); ok {
+				// rather than base64
+				v = string(b)
+			}
+			s.Row = append(s.Row, v)
+		}
+	}
+	return s
+}
+
+// An action Elasticsearch rejected, as a line of the dead-letter file
+type deadLetter struct {
+	Time    time.Time             `json:"time"`
+	Status  int                   `json:"status"`
+	Error   *elastic.ErrorDetails `json:"error,omitempty"`
+	Request []string              `json:"request"`
+	Source  *ActionSource         `json:"source,omitempty"`
+}
+
+func newDeadLetter(req elastic.BulkableRequest, source *ActionSource, item *elastic.BulkResponseItem) *deadLetter {
+	lines, err := req.Source()
+	if err != nil {
+		lines = []string{req.String()}
+	}
+	return &deadLetter{Time: time.Now(), Status: item.Status, Error: item.Error, Request: lines, Source: source}
+}
+
+// A bulk action read back from the dead-letter file, as it was sent
+type rawBulkRequest []string
+
+func (r rawBulkRequest) String() string {
+	return strings.Join(r, "\n")
+}
+
+func (r rawBulkRequest) Source() ([]string, error) {
+	return r, nil
+}
+
+// Appends actions Elasticsearch rejected, one JSON object per line, to a file
+// they can be replayed from once the cause, such as a mapping conflict, is fixed
+type DeadLetterQueue struct {
+	path string
+	m    sync.Mutex
+}
+
+func NewDeadLetterQueue(path string) *DeadLetterQueue {
+	return &DeadLetterQueue{path: path}
+}
+
+func (q *DeadLetterQueue) Write(letters []*deadLetter) error {
+	q.m.Lock()
+	defer q.m.Unlock()
+	f, err := os.OpenFile(q.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, letter := range letters {
+		if err = enc.Encode(letter); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		log.Warnf("Dead-lettered %d actions to %s", len(letters), q.path)
+	}
+	return errors.Trace(err)
+}
+
+// Resubmits the dead-lettered actions through the bulker, returning how many were
+// replayed. Actions rejected again are dead-lettered again. The queue is moved
+// aside while it's replayed, and a replay interrupted before it finished is
+// resumed by the next one.
+func (q *DeadLetterQueue) Replay(b *Bulker) (int, error) {
+	replay := q.path + ".replay"
+	if _, err := os.Stat(replay); os.IsNotExist(err) {
+		q.m.Lock()
+		err = os.Rename(q.path, replay)
+		q.m.Unlock()
+		if os.IsNotExist(err) {
+			return 0, nil
+		} else if err != nil {
+			return 0, errors.Trace(err)
+		}
+	} else if err != nil {
+		return 0, errors.Trace(err)
+	} else {
+		log.Infof("Resuming replay of %s", replay)
+	}
+
+	f, err := os.Open(replay)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer f.Close()
+
+	b.DeadLetters = q
+	count := 0
+	scanner := bufio.NewScanner(f)
+	// documents may be large
+	scanner.Buffer(make([]byte, 64*1024), int(b.MaxBytes)+1024*1024)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var letter deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			return count, errors.Annotatef(err, "reading line %d of %s", count+1, replay)
+		} else if len(letter.Request) == 0 {
+			return count, errors.Errorf("line %d of %s has no request", count+1, replay)
+		}
+		if err := b.AddFrom(letter.Source, []elastic.BulkableRequest{rawBulkRequest(letter.Request)}); err != nil {
+			return count, errors.Trace(err)
+		}
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return count, errors.Trace(err)
+	}
+	if err := b.Submit(); err != nil {
+		return count, errors.Trace(err)
+	}
+	return count, errors.Trace(os.Remove(replay))
+}
+
+// Returns the dead-letter file configured, or the default in the data directory
+func deadLetterPath(c *config.Config) string {
+	if len(c.DeadLetterFile) > 0 {
+		return c.DeadLetterFile
+	}
+	return filepath.Join(c.DataDir, "dead_letter.json")
+}
+
+// Replays the dead-letter queue of the river configured, returning how many
+// actions were replayed
+func ReplayDeadLetters(c *config.Config) (int, error) {
+	es, err := newEsClient(c)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	b := NewBulker(es, c.EsMaxActions, c.EsMaxBytes)
+	b.MaxRetries = c.EsMaxRetries
+	b.Workers = c.EsWorkers
+	b.QueueSize = c.EsQueueSize
+	defer b.Close()
+	return NewDeadLetterQueue(deadLetterPath(c)).Replay(b)
+}
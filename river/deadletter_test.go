@@ -0,0 +1,205 @@
+package river
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ehalpern/go-mysql/canal"
+	"github.com/ehalpern/go-mysql/mysql"
+	"github.com/ehalpern/go-mysql/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// Fakes the bulk endpoint, answering each request with the next list of item
+// statuses, or 200s once they run out. If release is set, each request waits to
+// receive from it.
+type fakeBulkServer struct {
+	*httptest.Server
+	release chan struct{}
+
+	m        sync.Mutex
+	statuses [][]int
+	bodies   []string
+}
+
+func newFakeBulkServer(statuses ...[]int) *fakeBulkServer {
+	s := &fakeBulkServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveBulk))
+	return s
+}
+
+func (s *fakeBulkServer) serveBulk(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if s.release != nil {
+		<-s.release
+	}
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+
+	s.m.Lock()
+	s.bodies = append(s.bodies, string(body))
+	var statuses []int
+	if len(s.statuses) > 0 {
+		statuses, s.statuses = s.statuses[0], s.statuses[1:]
+	}
+	s.m.Unlock()
+
+	var items []map[string]interface{}
+	errors := false
+	for i := 0; i < len(lines); i += 2 {
+		// index actions, the only ones tested, are followed by their document
+		status := http.StatusOK
+		if len(items) < len(statuses) {
+			status = statuses[len(items)]
+		}
+		item := map[string]interface{}{"_index": "idx", "_type": "t1", "status": status}
+		if status >= 300 {
+			errors = true
+			errorType := fmt.Sprintf("error_%d", status)
+			if status == http.StatusConflict {
+				errorType = "version_conflict_engine_exception"
+			}
+			item["error"] = map[string]interface{}{"type": errorType, "reason": "failed"}
+		}
+		items = append(items, map[string]interface{}{"index": item})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"took": 1, "errors": errors, "items": items})
+}
+
+func (s *fakeBulkServer) requests() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return len(s.bodies)
+}
+
+func newFakeBulker(t *testing.T, s *fakeBulkServer) *Bulker {
+	es, err := elastic.NewClient(elastic.SetURL(s.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	require.Nil(t, err)
+	b := NewBulker(es, 10, 1024*1024)
+	b.RetryBackoff = time.Millisecond
+	// so every action is in one request, sent when submitted
+	b.Workers = 1
+	b.FlushInterval = 0
+	return b
+}
+
+func readDeadLetters(t *testing.T, path string) []*deadLetter {
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	var letters []*deadLetter
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var letter deadLetter
+		require.Nil(t, json.Unmarshal([]byte(line), &letter))
+		letters = append(letters, &letter)
+	}
+	return letters
+}
+
+func TestDeadLetterRetry(t *testing.T) {
+	s := newFakeBulkServer([]int{http.StatusOK, http.StatusTooManyRequests}, []int{http.StatusServiceUnavailable})
+	defer s.Close()
+	b := newFakeBulker(t, s)
+	defer b.Close()
+	var acked uint64
+	b.OnAcknowledged = func(seq uint64) { acked = seq }
+
+	b.Add([]elastic.BulkableRequest{insertAction("idx", "t1", "1"), insertAction("idx", "t1", "2")})
+	assert.Nil(t, b.Submit())
+	assert.Equal(t, 3, s.requests())
+	assert.Equal(t, uint64(1), acked)
+	assert.Equal(t, 0, b.Count())
+	// only the rejected action is retried
+	assert.Contains(t, s.bodies[1], `"_id":"2"`)
+	assert.NotContains(t, s.bodies[1], `"_id":"1"`)
+
+	s.statuses = [][]int{{http.StatusTooManyRequests}, {http.StatusTooManyRequests}}
+	b.MaxRetries = 1
+	b.Add([]elastic.BulkableRequest{insertAction("idx", "t1", "3")})
+	assert.NotNil(t, b.Submit())
+	assert.Equal(t, uint64(1), acked)
+	// nothing more is sent
+	assert.NotNil(t, b.Add([]elastic.BulkableRequest{insertAction("idx", "t1", "4")}))
+	assert.Equal(t, 5, s.requests())
+}
+
+func TestDeadLetterRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead_letter.json")
+
+	s := newFakeBulkServer([]int{http.StatusBadRequest, http.StatusOK})
+	defer s.Close()
+	b := newFakeBulker(t, s)
+	defer b.Close()
+	b.DeadLetters = NewDeadLetterQueue(path)
+	var acked uint64
+	b.OnAcknowledged = func(seq uint64) { acked = seq }
+
+	table := &schema.Table{Schema: "test", Name: "t1"}
+	e := &canal.RowsEvent{Table: table, Action: canal.InsertAction,
+		Rows: [][]interface{}{{int64(1), []byte("abc")}}, Position: mysql.Position{Name: "mysql-bin.000001", Pos: 120}}
+	b.AddFrom(newActionSource(e, e.Rows), []elastic.BulkableRequest{insertAction("idx", "t1", "1")})
+	b.Add([]elastic.BulkableRequest{insertAction("idx", "t1", "2")})
+	assert.Nil(t, b.Submit())
+	assert.Equal(t, 1, s.requests())
+	assert.Equal(t, uint64(2), acked)
+
+	letters := readDeadLetters(t, path)
+	require.Len(t, letters, 1)
+	assert.Equal(t, http.StatusBadRequest, letters[0].Status)
+	assert.Equal(t, "error_400", letters[0].Error.Type)
+	assert.Len(t, letters[0].Request, 2)
+	assert.Contains(t, letters[0].Request[0], `"_id":"1"`)
+	assert.Equal(t, &ActionSource{Schema: "test", Table: "t1", Action: "insert",
+		Row: []interface{}{float64(1), "abc"}, BinlogName: "mysql-bin.000001", BinlogPos: 120}, letters[0].Source)
+
+	// replayed as they were sent
+	count, err := NewDeadLetterQueue(path).Replay(b)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, strings.Join(letters[0].Request, "\n")+"\n", s.bodies[1])
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path + ".replay")
+	assert.True(t, os.IsNotExist(err))
+
+	// and go back in the queue if rejected again
+	assert.Nil(t, b.DeadLetters.Write(letters))
+	s.statuses = [][]int{{http.StatusBadRequest}}
+	count, err = NewDeadLetterQueue(path).Replay(b)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	again := readDeadLetters(t, path)
+	require.Len(t, again, 1)
+	assert.Equal(t, letters[0].Request, again[0].Request)
+	assert.Equal(t, letters[0].Source, again[0].Source)
+
+	// nothing to replay
+	os.Remove(path)
+	count, err = NewDeadLetterQueue(path).Replay(b)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	assert.Equal(t, 100*time.Millisecond, retryBackoff(100*time.Millisecond, 1))
+	assert.Equal(t, 200*time.Millisecond, retryBackoff(100*time.Millisecond, 2))
+	assert.Equal(t, 800*time.Millisecond, retryBackoff(100*time.Millisecond, 4))
+	assert.Equal(t, MaxRetryBackoff, retryBackoff(100*time.Millisecond, 20))
+
+	assert.True(t, retryableError(fmt.Errorf("connection refused")))
+	assert.True(t, retryableError(&elastic.Error{Status: http.StatusServiceUnavailable}))
+	assert.False(t, retryableError(&elastic.Error{Status: http.StatusBadRequest}))
+}
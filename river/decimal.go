@@ -0,0 +1,91 @@
+package river
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/ehalpern/go-mysql/schema"
+	"github.com/siddontang/go/log"
+)
+
+// Converts a DECIMAL value, an exact string, to the representation of the field
+// type: a string with the column's scale, a float, or an integer scaled by
+// 10^scale, as a scaled_float stores it
+func convertDecimal(col *schema.TableColumn, value interface{}, ftype string) interface{} {
+	var s string
+	switch value := value.(type) {
+	case string:
+		s = value
+	case []byte:
+		s = string(value)
+	case float64:
+		s = strconv.FormatFloat(value, 'f', -1, 64)
+	case int64:
+		s = strconv.FormatInt(value, 10)
+	default:
+		return value
+	}
+	sign, intPart, frac, ok := splitDecimal(s, col.Decimals)
+	if !ok {
+		log.Warnf("Sending invalid decimal '%s' of column %s as is", s, col.Name)
+		return s
+	}
+
+	switch ftype {
+	case fieldTypeString:
+		if len(frac) > 0 {
+			return sign + intPart + "." + frac
+		}
+		return sign + intPart
+	case fieldTypeScaledFloat:
+		digits := strings.TrimLeft(intPart+frac, "0")
+		if len(digits) == 0 {
+			return int64(0)
+		}
+		n, err := strconv.ParseInt(sign+digits, 10, 64)
+		if err != nil {
+			// larger than a long, which Elasticsearch can't scale either
+			log.Warnf("Sending decimal %s of column %s unscaled: %v", s, col.Name, err)
+			return json.Number(sign + digits)
+		}
+		return n
+	default:
+		f, _ := strconv.ParseFloat(s, 64)
+		return f
+	}
+}
+
+// Splits a decimal into its sign, integral digits without leading zeros and
+// exactly scale fractional digits, truncating any more. Returns false if s isn't a
+// decimal.
+func splitDecimal(s string, scale int) (string, string, string, bool) {
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	intPart, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, frac = s[:i], s[i+1:]
+	}
+	if len(intPart)+len(frac) == 0 || !isDigits(intPart) || !isDigits(frac) {
+		return "", "", "", false
+	}
+	if intPart = strings.TrimLeft(intPart, "0"); len(intPart) == 0 {
+		intPart = "0"
+	}
+	frac = (frac + strings.Repeat("0", scale))[:scale]
+	if intPart == "0" && strings.Trim(frac, "0") == "" {
+		sign = ""
+	}
+	return sign, intPart, frac, true
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
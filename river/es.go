@@ -0,0 +1,99 @@
+package river
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/ehalpern/mysql2es/config"
+	"github.com/juju/errors"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// Returns a client of the Elasticsearch configured, authenticating every request,
+// including those sniffing the cluster's nodes, with the credentials configured
+func newEsClient(c *config.Config, options ...elastic.ClientOptionFunc) (*elastic.Client, error) {
+	scheme, url := esURL(c)
+	transport, err := esTransport(c)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	opts := []elastic.ClientOptionFunc{
+		elastic.SetURL(url),
+		// of the nodes sniffed
+		elastic.SetScheme(scheme),
+		elastic.SetHttpClient(&http.Client{Transport: transport}),
+	}
+	if len(c.EsUser) > 0 {
+		password, err := esPassword(c)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		opts = append(opts, elastic.SetBasicAuth(c.EsUser, password))
+	}
+	es, err := elastic.NewClient(append(opts, options...)...)
+	return es, errors.Trace(err)
+}
+
+// Returns the scheme and URL of es_host, which may include the scheme
+func esURL(c *config.Config) (string, string) {
+	if i := strings.Index(c.EsHost, "://"); i >= 0 {
+		return c.EsHost[:i], c.EsHost
+	}
+	scheme := c.EsScheme
+	if len(scheme) == 0 {
+		scheme = "http"
+	}
+	return scheme, scheme + "://" + c.EsHost
+}
+
+// Returns es_pass, or the first line of es_pass_file
+func esPassword(c *config.Config) (string, error) {
+	if len(c.EsPasswordFile) == 0 {
+		return c.EsPassword, nil
+	} else if len(c.EsPassword) > 0 {
+		return "", errors.New("es_pass and es_pass_file are exclusive")
+	}
+	data, err := ioutil.ReadFile(c.EsPasswordFile)
+	if err != nil {
+		return "", errors.Annotate(err, "reading es_pass_file")
+	}
+	return strings.TrimRight(strings.SplitN(string(data), "\n", 2)[0], "\r"), nil
+}
+
+func esTransport(c *config.Config) (http.RoundTripper, error) {
+	tlsConfig, err := newTLSConfig("es_", c.EsCaCert, c.EsClientCert, c.EsClientKey, c.EsInsecureSkipVerify)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+	if len(c.EsApiKey) > 0 {
+		if len(c.EsUser) > 0 {
+			return nil, errors.New("es_user and es_api_key are exclusive")
+		}
+		transport = &apiKeyTransport{c.EsApiKey, transport}
+	}
+	return transport, nil
+}
+
+// Authenticates requests with an Elasticsearch API key, the base64 encoding of its
+// id and key as returned when it was created
+type apiKeyTransport struct {
+	key       string
+	transport http.RoundTripper
+}
+
+func (t *apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper mustn't modify the request
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", "ApiKey "+t.key)
+	return t.transport.RoundTrip(r)
+}
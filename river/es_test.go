@@ -0,0 +1,148 @@
+package river
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ehalpern/mysql2es/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// Fakes an Elasticsearch node over TLS, recording the Authorization header of
+// every request
+type fakeTLSServer struct {
+	*httptest.Server
+
+	m     sync.Mutex
+	auths map[string]string
+}
+
+func newFakeTLSServer() *fakeTLSServer {
+	s := &fakeTLSServer{auths: make(map[string]string)}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *fakeTLSServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	s.auths[r.URL.Path] = r.Header.Get("Authorization")
+	s.m.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path == "/_nodes/http" {
+		addr := strings.TrimPrefix(s.URL, "https://")
+		fmt.Fprintf(w, `{"cluster_name":"test","nodes":{"n1":{"name":"n1","http":{"publish_address":"%s"},`+
+			`"https_address":"%s"}}}`, addr, addr)
+	}
+}
+
+func (s *fakeTLSServer) auth(path string) string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.auths[path]
+}
+
+// Writes the server's certificate as the CA bundle
+func writeCACert(t *testing.T, s *fakeTLSServer, dir string) string {
+	path := filepath.Join(dir, "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	require.Nil(t, ioutil.WriteFile(path, data, 0600))
+	return path
+}
+
+func newHTTPSConfig(s *fakeTLSServer) *config.Config {
+	c := config.Default
+	c.EsHost = strings.TrimPrefix(s.URL, "https://")
+	c.EsScheme = "https"
+	return &c
+}
+
+func TestEsClientBasicAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "es")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := newFakeTLSServer()
+	defer s.Close()
+
+	c := newHTTPSConfig(s)
+	c.EsCaCert = writeCACert(t, s, dir)
+	c.EsUser = "elastic"
+	c.EsPasswordFile = filepath.Join(dir, "es_pass")
+	require.Nil(t, ioutil.WriteFile(c.EsPasswordFile, []byte("secret\n"), 0600))
+
+	es, err := newEsClient(c)
+	require.Nil(t, err)
+	_, err = es.IndexExists("idx").Do()
+	assert.Nil(t, err)
+	// "elastic:secret"
+	assert.Equal(t, "Basic ZWxhc3RpYzpzZWNyZXQ=", s.auth("/_nodes/http"))
+	assert.Equal(t, "Basic ZWxhc3RpYzpzZWNyZXQ=", s.auth("/idx"))
+
+	c.EsPassword = "secret"
+	_, err = newEsClient(c)
+	assert.NotNil(t, err)
+}
+
+func TestEsClientApiKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "es")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := newFakeTLSServer()
+	defer s.Close()
+
+	c := newHTTPSConfig(s)
+	c.EsHost = s.URL
+	c.EsScheme = ""
+	c.EsCaCert = writeCACert(t, s, dir)
+	c.EsApiKey = "a2V5OnNlY3JldA=="
+	es, err := newEsClient(c)
+	require.Nil(t, err)
+	_, err = es.IndexExists("idx").Do()
+	assert.Nil(t, err)
+	assert.Equal(t, "ApiKey a2V5OnNlY3JldA==", s.auth("/_nodes/http"))
+	assert.Equal(t, "ApiKey a2V5OnNlY3JldA==", s.auth("/idx"))
+
+	c.EsUser = "elastic"
+	_, err = newEsClient(c)
+	assert.NotNil(t, err)
+}
+
+func TestEsClientTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "es")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := newFakeTLSServer()
+	defer s.Close()
+
+	// the server's certificate isn't trusted
+	c := newHTTPSConfig(s)
+	_, err = newEsClient(c, elastic.SetHealthcheckTimeoutStartup(100*time.Millisecond))
+	assert.NotNil(t, err)
+
+	c.EsInsecureSkipVerify = true
+	es, err := newEsClient(c)
+	require.Nil(t, err)
+	_, err = es.IndexExists("idx").Do()
+	assert.Nil(t, err)
+	assert.Equal(t, "", s.auth("/idx"))
+
+	c.EsCaCert = filepath.Join(dir, "empty.pem")
+	require.Nil(t, ioutil.WriteFile(c.EsCaCert, []byte("not a certificate"), 0600))
+	_, err = newEsClient(c)
+	assert.NotNil(t, err)
+
+	c.EsCaCert = ""
+	c.EsClientCert = filepath.Join(dir, "client.pem")
+	_, err = newEsClient(c)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,54 @@
+package river
+
+import (
+	"strings"
+
+	"github.com/ehalpern/go-mysql/mysql"
+	"github.com/ehalpern/go-mysql/schema"
+	"github.com/siddontang/go/log"
+)
+
+// Converts a spatial value to a geo_point, {"lat": y, "lon": x}, or the GeoJSON
+// geo_shape expects. Values still in MySQL's internal format, as mydumper dumps
+// them, are parsed here.
+func convertGeometry(col *schema.TableColumn, value interface{}, ftype string) interface{} {
+	var g *mysql.Geometry
+	var err error
+	switch value := value.(type) {
+	case *mysql.Geometry:
+		g = value
+	case []byte:
+		g, err = mysql.ParseGeometry(value)
+	case string:
+		g, err = mysql.ParseGeometry([]byte(value))
+	default:
+		return value
+	}
+	if err != nil {
+		log.Warnf("Sending invalid geometry of column %s as null: %v", col.Name, err)
+		return nil
+	}
+
+	if ftype == "" && strings.HasPrefix(col.RawType, "point") {
+		ftype = fieldTypeGeoPoint
+	}
+	if ftype != fieldTypeGeoPoint {
+		return geoJSON(g)
+	} else if g.Type != "Point" {
+		log.Warnf("Sending %s of column %s as null, only points are geo_points", g.Type, col.Name)
+		return nil
+	}
+	xy := g.Coordinates.([]float64)
+	return map[string]interface{}{"lat": xy[1], "lon": xy[0]}
+}
+
+func geoJSON(g *mysql.Geometry) map[string]interface{} {
+	if g.Type != "GeometryCollection" {
+		return map[string]interface{}{"type": g.Type, "coordinates": g.Coordinates}
+	}
+	geometries := make([]interface{}, len(g.Geometries))
+	for i, m := range g.Geometries {
+		geometries[i] = geoJSON(m)
+	}
+	return map[string]interface{}{"type": g.Type, "geometries": geometries}
+}
@@ -0,0 +1,202 @@
+package river
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ehalpern/go-mysql/canal"
+	"github.com/ehalpern/mysql2es/config"
+	"github.com/juju/errors"
+	"github.com/siddontang/go/log"
+)
+
+// Tracks how far Elasticsearch is behind the source. Changes read from the binlog
+// are behind until Elasticsearch acknowledges the bulker Add they were converted
+// in, and every Add before it. Heartbeats written by the river measure the round
+// trip through the binlog into Elasticsearch even when the source is idle.
+type lagTracker struct {
+	m sync.Mutex
+	// number of the last Add acknowledged
+	acked uint64
+	// changes and heartbeats not yet acknowledged, oldest first
+	pending []lagMark
+	// when the newest acknowledged heartbeat was written, and acknowledged
+	lastHeartbeat time.Time
+	lastApplied   time.Time
+}
+
+type lagMark struct {
+	seq uint64
+	// when the change was written on the master, in unix seconds, if a change
+	timestamp uint32
+	// when the heartbeat was written, if a heartbeat
+	heartbeat time.Time
+}
+
+type heartbeatStatus struct {
+	Written          time.Time `json:"written"`
+	Applied          time.Time `json:"applied"`
+	RoundTripSeconds float64   `json:"round_trip_seconds"`
+	FreshnessSeconds float64   `json:"freshness_seconds"`
+}
+
+// Records a change read from the binlog that was written at timestamp and added
+// in Add number seq
+func (l *lagTracker) added(seq uint64, timestamp uint32) {
+	l.mark(lagMark{seq: seq, timestamp: timestamp})
+}
+
+func (l *lagTracker) addedHeartbeat(seq uint64, written time.Time) {
+	l.mark(lagMark{seq: seq, heartbeat: written})
+}
+
+func (l *lagTracker) mark(m lagMark) {
+	l.m.Lock()
+	if m.seq > l.acked {
+		l.pending = append(l.pending, m)
+	}
+	l.m.Unlock()
+}
+
+// Records that Elasticsearch has acknowledged Add number seq and every one before it
+func (l *lagTracker) acknowledged(seq uint64, now time.Time) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if seq > l.acked {
+		l.acked = seq
+	}
+	for len(l.pending) > 0 && l.pending[0].seq <= seq {
+		if hb := l.pending[0].heartbeat; hb.After(l.lastHeartbeat) {
+			l.lastHeartbeat, l.lastApplied = hb, now
+		}
+		l.pending = l.pending[1:]
+	}
+}
+
+// Returns the age of the oldest change read from the binlog but not yet in
+// Elasticsearch, or 0 if there is none
+func (l *lagTracker) secondsBehind(now time.Time) float64 {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for _, m := range l.pending {
+		if m.timestamp == 0 {
+			continue
+		}
+		if behind := now.Sub(time.Unix(int64(m.timestamp), 0)).Seconds(); behind > 0 {
+			return behind
+		}
+		return 0
+	}
+	return 0
+}
+
+// Returns the newest heartbeat to have reached Elasticsearch, or nil if none has.
+// Its freshness is the age of the newest change known to be in Elasticsearch.
+func (l *lagTracker) heartbeatStatus(now time.Time) *heartbeatStatus {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.lastHeartbeat.IsZero() {
+		return nil
+	}
+	return &heartbeatStatus{
+		Written:          l.lastHeartbeat,
+		Applied:          l.lastApplied,
+		RoundTripSeconds: l.lastApplied.Sub(l.lastHeartbeat).Seconds(),
+		FreshnessSeconds: now.Sub(l.lastHeartbeat).Seconds(),
+	}
+}
+
+// Creates the heartbeat table and returns the rule syncing it into Elasticsearch,
+// or nil if heartbeats aren't configured
+func (r *River) prepareHeartbeat() (*config.Rule, error) {
+	if len(r.config.DbHeartbeatTable) == 0 {
+		return nil, nil
+	}
+	names := strings.SplitN(r.config.DbHeartbeatTable, ".", 2)
+	if len(names) != 2 {
+		return nil, errors.Errorf("heartbeat table %s must be db.table", r.config.DbHeartbeatTable)
+	}
+	if _, err := r.canal.Execute(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s "+
+		"(id BIGINT NOT NULL PRIMARY KEY, ts BIGINT NOT NULL)", r.config.DbHeartbeatTable)); err != nil {
+		return nil, errors.Annotatef(err, "creating heartbeat table %s", r.config.DbHeartbeatTable)
+	}
+	rule := config.NewDefaultRule(names[0], names[1])
+	var err error
+	if rule.TableInfo, err = r.canal.GetTable(rule.Schema, rule.Table); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return rule, nil
+}
+
+func (r *River) isHeartbeat(e *canal.RowsEvent) bool {
+	return r.heartbeat != nil && e.Table.Schema == r.heartbeat.Schema && e.Table.Name == r.heartbeat.Table
+}
+
+// Writes a heartbeat, identified by the river's slave id, at every interval
+func (r *River) runHeartbeat() {
+	defer r.wg.Done()
+	interval := time.Duration(r.config.HeartbeatInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if _, err := r.canal.Execute(fmt.Sprintf("REPLACE INTO %s (id, ts) VALUES (?, ?)",
+				r.config.DbHeartbeatTable), r.config.DbSlaveID, now.UnixNano()/int64(time.Millisecond)); err != nil {
+				log.Warnf("Failed to write heartbeat: %v", err)
+			}
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// Returns when the river's heartbeats in the rows were written, skipping the
+// heartbeats of other rivers sharing the table
+func heartbeatTimes(rule *config.Rule, serverID uint32, e *canal.RowsEvent) []time.Time {
+	if e.Action == canal.DeleteAction {
+		return nil
+	}
+	idColumn, tsColumn := rule.TableInfo.FindColumn("id"), rule.TableInfo.FindColumn("ts")
+	if idColumn < 0 || tsColumn < 0 {
+		return nil
+	}
+	var times []time.Time
+	for i, row := range e.Rows {
+		if e.Action == canal.UpdateAction && i%2 == 0 {
+			// before image
+			continue
+		} else if len(row) <= idColumn || len(row) <= tsColumn {
+			continue
+		}
+		id, ok := intValue(row[idColumn])
+		if !ok || id != int64(serverID) {
+			continue
+		}
+		if ts, ok := intValue(row[tsColumn]); ok {
+			times = append(times, time.Unix(0, ts*int64(time.Millisecond)))
+		}
+	}
+	return times
+}
+
+func intValue(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return v, true
+	case int32:
+		return int64(v), true
+	case uint64:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case int:
+		return int64(v), true
+	}
+	return 0, false
+}
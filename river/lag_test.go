@@ -0,0 +1,55 @@
+package river
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ehalpern/go-mysql/canal"
+	"github.com/ehalpern/go-mysql/schema"
+	"github.com/ehalpern/mysql2es/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecondsBehind(t *testing.T) {
+	var l lagTracker
+	now := time.Unix(1000, 0)
+	assert.Equal(t, 0.0, l.secondsBehind(now))
+
+	// the oldest unacknowledged change counts
+	l.added(1, 990)
+	l.added(2, 995)
+	assert.Equal(t, 10.0, l.secondsBehind(now))
+	l.acknowledged(1, now)
+	assert.Equal(t, 5.0, l.secondsBehind(now))
+	l.acknowledged(2, now)
+	assert.Equal(t, 0.0, l.secondsBehind(now))
+	assert.Nil(t, l.heartbeatStatus(now))
+
+	// changes added once acknowledged aren't behind
+	l.added(2, 990)
+	assert.Equal(t, 0.0, l.secondsBehind(now))
+
+	l.addedHeartbeat(3, time.Unix(998, 0))
+	l.acknowledged(2, time.Unix(999, 0))
+	assert.Nil(t, l.heartbeatStatus(now))
+	l.acknowledged(3, time.Unix(999, 0))
+	hb := l.heartbeatStatus(now)
+	assert.Equal(t, 1.0, hb.RoundTripSeconds)
+	assert.Equal(t, 2.0, hb.FreshnessSeconds)
+}
+
+func TestHeartbeatTimes(t *testing.T) {
+	rule := config.NewDefaultRule("meta", "heartbeat")
+	rule.TableInfo = &schema.Table{Schema: "meta", Name: "heartbeat"}
+	rule.TableInfo.AddColumn("id", "bigint(20)", "")
+	rule.TableInfo.AddColumn("ts", "bigint(20)", "")
+
+	e := &canal.RowsEvent{Table: rule.TableInfo, Action: canal.UpdateAction, Rows: [][]interface{}{
+		{int64(1001), int64(1000)}, {int64(1001), int64(2500)},
+		{int64(1002), int64(1000)}, {int64(1002), int64(3000)},
+	}}
+	assert.Equal(t, []time.Time{time.Unix(2, 500*int64(time.Millisecond))}, heartbeatTimes(rule, 1001, e))
+
+	e.Action = canal.DeleteAction
+	assert.Empty(t, heartbeatTimes(rule, 1001, e))
+}
@@ -0,0 +1,206 @@
+package river
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics are exposed on the status server's /metrics in the Prometheus text format.
+var (
+	metrics = new(metricRegistry)
+
+	eventsTotal = metrics.counter("mysql2es_events_total",
+		"Rows events processed", "schema", "table", "action")
+	bulkDuration = metrics.histogram("mysql2es_bulk_request_duration_seconds",
+		"Time taken by bulk requests to Elasticsearch",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30})
+	bulkFailures = metrics.counter("mysql2es_bulk_failures_total",
+		"Failed bulk requests and actions by Elasticsearch error type", "type")
+	bulkVersionConflicts = metrics.counter("mysql2es_bulk_version_conflicts_total",
+		"Actions ignored by Elasticsearch for being older than the document under external versioning")
+	bulkQueueDepth = metrics.gauge("mysql2es_bulk_queue_depth",
+		"Actions added but not yet acknowledged by Elasticsearch")
+	bulkSentBytes = metrics.counter("mysql2es_bulk_sent_bytes_total",
+		"Bytes of bulk requests sent to Elasticsearch")
+	binlogLagSeconds = metrics.gauge("mysql2es_binlog_lag_seconds",
+		"Age of the last binlog event read, or 0 once the master's position has been read")
+	binlogLagBytes = metrics.gauge("mysql2es_binlog_lag_bytes",
+		"Bytes of binlog written by the master beyond the synced position")
+	secondsBehindSource = metrics.gauge("mysql2es_seconds_behind_source",
+		"Age of the oldest change read from the binlog but not yet acknowledged by Elasticsearch")
+	heartbeatFreshness = metrics.gauge("mysql2es_heartbeat_freshness_seconds",
+		"Age of the newest heartbeat acknowledged by Elasticsearch")
+)
+
+const (
+	counterMetric   = "counter"
+	gaugeMetric     = "gauge"
+	histogramMetric = "histogram"
+)
+
+type metricRegistry struct {
+	metrics []*metric
+}
+
+// A metric with a value, or histogram, for each combination of label values
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	m      sync.Mutex
+	values map[string]*metricValue
+}
+
+type metricValue struct {
+	labels []string
+	value  float64
+	// histograms only, counts by bucket
+	counts []uint64
+	count  uint64
+}
+
+func (r *metricRegistry) register(m *metric) *metric {
+	m.values = make(map[string]*metricValue)
+	if len(m.labels) == 0 {
+		// shown from the start
+		m.value(nil)
+	}
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+func (r *metricRegistry) counter(name string, help string, labels ...string) *metric {
+	return r.register(&metric{name: name, help: help, kind: counterMetric, labels: labels})
+}
+
+func (r *metricRegistry) gauge(name string, help string, labels ...string) *metric {
+	return r.register(&metric{name: name, help: help, kind: gaugeMetric, labels: labels})
+}
+
+func (r *metricRegistry) histogram(name string, help string, buckets []float64, labels ...string) *metric {
+	return r.register(&metric{name: name, help: help, kind: histogramMetric, labels: labels, buckets: buckets})
+}
+
+// Writes every metric in the text format
+func (r *metricRegistry) write(w io.Writer) error {
+	for _, m := range r.metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the value for the label values, which must be locked
+func (m *metric) value(labels []string) *metricValue {
+	key := strings.Join(labels, "\x00")
+	v := m.values[key]
+	if v == nil {
+		v = &metricValue{labels: labels}
+		if m.kind == histogramMetric {
+			v.counts = make([]uint64, len(m.buckets))
+		}
+		m.values[key] = v
+	}
+	return v
+}
+
+func (m *metric) add(delta float64, labels ...string) {
+	m.m.Lock()
+	m.value(labels).value += delta
+	m.m.Unlock()
+}
+
+func (m *metric) set(value float64, labels ...string) {
+	m.m.Lock()
+	m.value(labels).value = value
+	m.m.Unlock()
+}
+
+// Records an observation of a histogram, whose value is the sum of observations
+func (m *metric) observe(value float64, labels ...string) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	v := m.value(labels)
+	for i, bound := range m.buckets {
+		if value <= bound {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.value += value
+}
+
+func (m *metric) write(w io.Writer) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := m.values[key]
+		labels := formatLabels(m.labels, v.labels)
+		if m.kind != histogramMetric {
+			if _, err := fmt.Fprintf(w, "%s%s %s\n", m.name, labels, formatValue(v.value)); err != nil {
+				return err
+			}
+			continue
+		}
+		names := append(append([]string{}, m.labels...), "le")
+		values := append(append([]string{}, v.labels...), "")
+		for i, bound := range m.buckets {
+			values[len(values)-1] = formatValue(bound)
+			le := formatLabels(names, values)
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, le, v.counts[i]); err != nil {
+				return err
+			}
+		}
+		values[len(values)-1] = "+Inf"
+		le := formatLabels(names, values)
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n", m.name, le, v.count,
+			m.name, labels, formatValue(v.value), m.name, labels, v.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + `="` + labelEscaper.Replace(value) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,39 @@
+package river
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	r := new(metricRegistry)
+	events := r.counter("events_total", "Events", "table", "action")
+	depth := r.gauge("queue_depth", "Depth")
+	latency := r.histogram("latency_seconds", "Latency", []float64{0.1, 1})
+
+	events.add(2, "t1", "insert")
+	events.add(1, `t"2`, "delete")
+	depth.set(5)
+	latency.observe(0.05)
+	latency.observe(0.5)
+
+	var buf bytes.Buffer
+	assert.Nil(t, r.write(&buf))
+	assert.Equal(t, `# HELP events_total Events
+# TYPE events_total counter
+events_total{table="t\"2",action="delete"} 1
+events_total{table="t1",action="insert"} 2
+# HELP queue_depth Depth
+# TYPE queue_depth gauge
+queue_depth 5
+# HELP latency_seconds Latency
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 2
+latency_seconds_sum 0.55
+latency_seconds_count 2
+`, buf.String())
+}
@@ -8,8 +8,10 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/ehalpern/go-mysql/canal"
+	"github.com/juju/errors"
 	"github.com/siddontang/go/log"
 	"github.com/ehalpern/mysql2es/config"
 	"gopkg.in/olivere/elastic.v3"
@@ -26,18 +28,31 @@ type River struct {
 	wg     sync.WaitGroup
 	es     *elastic.Client
 	st     *stat
+	bulker *Bulker
+
+	// new versions of indexes being filled by Reindex, by alias
+	rl         sync.Mutex
+	reindexing map[string]string
+
+	lag lagTracker
+	// syncs the heartbeat table, if configured
+	heartbeat *config.Rule
 }
 
 func NewRiver(c *config.Config) (*River, error) {
 	r := new(River)
 	r.config = c
 	r.quit = make(chan struct{})
+	r.reindexing = make(map[string]string)
+	r.st = newStat(r)
 
 	if err := r.newCanal(); err != nil {
 		return nil, err
 	} else if r.rules, err = config.NewRuntime(c, r.canal); err != nil {
 		return nil, err
-	} else if r.es, err = elastic.NewClient(elastic.SetURL("http://" + r.config.EsHost)); err != nil {
+	} else if r.es, err = newEsClient(c); err != nil {
+		return nil, err
+	} else if r.heartbeat, err = r.prepareHeartbeat(); err != nil {
 		return nil, err
 	} else if err := r.prepareCanal(); err != nil {
 		return nil, err
@@ -56,9 +71,15 @@ func (r *River) newCanal() error {
 	cfg.Flavor = "mysql"
 	cfg.DataDir = r.config.DataDir
 	cfg.ServerID = r.config.DbSlaveID
+	cfg.GTIDMode = r.config.GTIDMode
+	cfg.WatermarkTable = r.config.DbWatermarkTable
 	cfg.Dump.ExecutionPath = r.config.DumpExec
 	cfg.Dump.DiscardErr = false
+	cfg.Dump.ChunkSize = r.config.DumpChunkSize
 	var err error
+	if cfg.TLSConfig, err = dbTLSConfig(r.config); err != nil {
+		return err
+	}
 	r.canal, err = canal.NewCanal(cfg)
 	return err
 }
@@ -73,8 +94,15 @@ func (r *River) prepareCanal() error {
 		r.canal.AddDumpDatabases(dbs...)
 	}
 
-	s := syncer{r.rules, NewBulker(r.es, r.config.EsMaxActions, r.config.EsMaxBytes)}
-	r.canal.RegRowsEventHandler(&s)
+	r.bulker = NewBulker(r.es, r.config.EsMaxActions, r.config.EsMaxBytes)
+	r.bulker.OnError = r.st.setError
+	r.bulker.MaxRetries = r.config.EsMaxRetries
+	r.bulker.Workers = r.config.EsWorkers
+	r.bulker.QueueSize = r.config.EsQueueSize
+	r.bulker.FlushInterval = time.Duration(r.config.EsFlushInterval) * time.Second
+	r.bulker.DeadLetters = NewDeadLetterQueue(deadLetterPath(r.config))
+	s := newSyncer(r, r.bulker)
+	r.canal.RegRowsEventHandler(s)
 
 	return nil
 }
@@ -96,7 +124,7 @@ func readIndexFile(configDir string, rule *config.Rule) ([]byte, error) {
 		if m := regexp.MustCompile("(.+)-[0-9]+").FindStringSubmatch(rule.Index); len(m) == 0 {
 			path = configDir + "/" + rule.Index + ".idx.json"
 		} else {
-			path = configDir + "/" + m[0] + ".idx.json"
+			path = configDir + "/" + m[1] + ".idx.json"
 		}
 		data, err := ioutil.ReadFile(path)
 		if os.IsNotExist(err) {
@@ -109,24 +137,43 @@ func readIndexFile(configDir string, rule *config.Rule) ([]byte, error) {
 }
 
 func (r *River) createIndexes() error {
-	configDir := filepath.Dir(r.config.ConfigFile)
 	for _, rule := range r.rules.Rules {
-		data, err := readIndexFile(configDir, rule)
-		if err != nil {
+		if err := r.createRuleIndex(rule); err != nil {
 			return err
-		} else if len(data) > 0 {
-			var settings map[string]interface{}
-			if err := json.Unmarshal(data, &settings); err != nil {
-				return err
-			}
-			if err := r.createIndex(rule.Index, settings); err != nil {
-				return err
-			}
 		}
 	}
 	return nil
 }
 
+// Creates the rule's index if it has settings and doesn't exist yet. The first
+// version of a versioned index is created even without settings, so the alias
+// can point to it.
+func (r *River) createRuleIndex(rule *config.Rule) error {
+	settings, err := r.indexSettings(rule)
+	if err != nil {
+		return err
+	} else if rule.Versions > 0 {
+		return r.createVersionedIndex(rule.Index, settings)
+	} else if settings != nil {
+		return r.createIndex(rule.Index, settings)
+	}
+	return nil
+}
+
+// Returns the settings and mappings to create the rule's index with, or nil if
+// there are none
+func (r *River) indexSettings(rule *config.Rule) (map[string]interface{}, error) {
+	data, err := readIndexFile(filepath.Dir(r.config.ConfigFile), rule)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	var settings map[string]interface{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
 func (r *River) createIndex(idx string, settings map[string]interface{}) error {
 	exists, err := r.es.IndexExists(idx).Do()
 	if exists {
@@ -138,6 +185,20 @@ func (r *River) createIndex(idx string, settings map[string]interface{}) error {
 	return err
 }
 
+// Resnapshot reads every row of a synced table into its index again while
+// replication continues, to repair the index or fill it after a mapping change.
+// It returns once the snapshot has started.
+func (r *River) Resnapshot(schema string, table string) error {
+	rule := r.rules.GetRule(schema, table)
+	if rule == nil {
+		return errors.Errorf("%s.%s is not synced", schema, table)
+	} else if err := r.createRuleIndex(rule); err != nil {
+		return err
+	}
+	_, err := r.canal.Resnapshot(schema, table)
+	return err
+}
+
 func (r *River) Run() error {
 	if err := r.createIndexes(); err != nil {
 		return err
@@ -145,12 +206,25 @@ func (r *River) Run() error {
 	if err := r.canal.Start(); err != nil {
 		return err
 	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.st.Run(r.config.StatAddr)
+	}()
+	if r.heartbeat != nil {
+		r.wg.Add(1)
+		go r.runHeartbeat()
+	}
 	return nil
 }
 
 func (r *River) Close() {
 	log.Infof("Closing river")
 	close(r.quit)
+	r.st.Close()
 	r.canal.Close()
 	r.wg.Wait()
+	if err := r.bulker.Close(); err != nil {
+		log.Errorf("Failed to submit remaining actions: %v", err)
+	}
 }
@@ -200,6 +200,18 @@ func (s *riverTestSuite) TestTableWildcards(c *C) {
 	}
 }
 
+func (s *riverTestSuite) TestCreateWildcardTable(c *C) {
+	s.riverRun(c)
+	table := tTable_(100)
+	s.dbExec(c, "DROP TABLE IF EXISTS "+table)
+	s.dbExec(c, "CREATE TABLE "+table+" LIKE "+tTable)
+	row := []interface{}{100, "100th", "hello 100", "e1", "a"}
+	s.dbInsert(c, table, fields, row)
+	s.riverWaitForSync(c)
+	s.esVerify(c, tIndex, tType, fields, row)
+	s.dbExec(c, "DROP TABLE "+table)
+}
+
 func (s *riverTestSuite) TestSchemaUpgrade(c *C) {
 	row := values[0]
 	s.dbInsert(c, tTable, fields, row)
@@ -1,48 +1,276 @@
 package river
 
 import (
-	"bytes"
-	"fmt"
+	"crypto/subtle"
+	"encoding/json"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/ehalpern/go-mysql/dump"
+	"github.com/juju/errors"
 	"github.com/siddontang/go/log"
 	"github.com/siddontang/go/sync2"
+	"gopkg.in/olivere/elastic.v3"
 )
 
+// Serves the status of the river as JSON on /stat and metrics on /metrics, and lets
+// tables be resnapshotted and indexes reindexed by POSTing to
+// /resnapshot?schema=&table= and /reindex?index= with the control token
 type stat struct {
 	r *River
 
-	l net.Listener
+	// guards srv and closing, and is read locked by control requests while they
+	// start, so none starts anything once closing
+	cl      sync.RWMutex
+	srv     *http.Server
+	closing bool
+
+	start time.Time
 
 	InsertNum sync2.AtomicInt64
 	UpdateNum sync2.AtomicInt64
 	DeleteNum sync2.AtomicInt64
+
+	// guards the fields below
+	m sync.Mutex
+	// actions converted from each table's rows, by schema.table
+	rules         map[string]*BulkerStats
+	lastError     string
+	lastErrorTime time.Time
 }
 
-func (s *stat) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var buf bytes.Buffer
+type position struct {
+	Name string `json:"name"`
+	Pos  uint32 `json:"pos"`
+}
+
+type bulkError struct {
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+type dumpStatus struct {
+	Done   bool                          `json:"done"`
+	Tables map[string]dump.TableProgress `json:"tables,omitempty"`
+}
+
+type status struct {
+	ServerPosition position                `json:"server_position"`
+	SyncedPosition position                `json:"synced_position"`
+	Uptime         string                  `json:"uptime"`
+	InsertNum      int64                   `json:"insert_num"`
+	UpdateNum      int64                   `json:"update_num"`
+	DeleteNum      int64                   `json:"delete_num"`
+	Rules          map[string]BulkerStats  `json:"rules"`
+	LastBulkError  *bulkError              `json:"last_bulk_error,omitempty"`
+	Dump           dumpStatus              `json:"dump"`
+	SecondsBehind  float64                 `json:"seconds_behind_source"`
+	Heartbeat      *heartbeatStatus        `json:"heartbeat,omitempty"`
+	Reindexing     map[string]string       `json:"reindexing,omitempty"`
+}
+
+func newStat(r *River) *stat {
+	return &stat{r: r, start: time.Now(), rules: make(map[string]*BulkerStats)}
+}
+
+// Counts the actions converted from rows of the table
+func (s *stat) add(schema string, table string, actions []elastic.BulkableRequest) {
+	var counts BulkerStats
+	counts.Add(actions)
+	s.InsertNum.Add(int64(counts.InsertCount))
+	s.UpdateNum.Add(int64(counts.UpdateCount))
+	s.DeleteNum.Add(int64(counts.DeleteCount))
+
+	key := schema + "." + table
+	s.m.Lock()
+	defer s.m.Unlock()
+	rule := s.rules[key]
+	if rule == nil {
+		rule = new(BulkerStats)
+		s.rules[key] = rule
+	}
+	rule.Add(actions)
+}
 
+func (s *stat) setError(err error) {
+	s.m.Lock()
+	s.lastError = err.Error()
+	s.lastErrorTime = time.Now()
+	s.m.Unlock()
+}
+
+func (s *stat) status() (*status, error) {
 	rr, err := s.r.canal.Execute("SHOW MASTER STATUS")
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("execute sql error %v", err)))
+		return nil, errors.Annotate(err, "reading master status")
+	}
+	st := &status{InsertNum: s.InsertNum.Get(), UpdateNum: s.UpdateNum.Get(), DeleteNum: s.DeleteNum.Get()}
+	st.ServerPosition.Name, _ = rr.GetString(0, 0)
+	pos, _ := rr.GetUint(0, 1)
+	st.ServerPosition.Pos = uint32(pos)
+	synced := s.r.canal.SyncedPosition()
+	st.SyncedPosition = position{synced.Name, synced.Pos}
+	st.Uptime = time.Since(s.start).String()
+	st.SecondsBehind = s.r.lag.secondsBehind(time.Now())
+	st.Heartbeat = s.r.lag.heartbeatStatus(time.Now())
+
+	s.m.Lock()
+	st.Rules = make(map[string]BulkerStats, len(s.rules))
+	for key, rule := range s.rules {
+		st.Rules[key] = *rule
+	}
+	if len(s.lastError) > 0 {
+		st.LastBulkError = &bulkError{s.lastError, s.lastErrorTime}
+	}
+	s.m.Unlock()
+
+	select {
+	case <-s.r.canal.WaitDumpDone():
+		st.Dump.Done = true
+	default:
+		st.Dump.Tables = s.r.canal.DumpProgress()
+	}
+
+	s.r.rl.Lock()
+	if len(s.r.reindexing) > 0 {
+		st.Reindexing = make(map[string]string, len(s.r.reindexing))
+		for index, next := range s.r.reindexing {
+			st.Reindexing[index] = next
+		}
+	}
+	s.r.rl.Unlock()
+	return st, nil
+}
+
+func (s *stat) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st, err := s.status()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, errorResponse(err))
 		return
 	}
+	writeJSON(w, http.StatusOK, st)
+}
 
-	binName, _ := rr.GetString(0, 0)
-	binPos, _ := rr.GetUint(0, 1)
+// Wraps a control request handler, which must be POSTed with the control token as
+// a bearer token. Control requests are refused if there's no token, or once the
+// server is closing.
+func (s *stat) serveControl(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeJSON(w, http.StatusMethodNotAllowed, errorResponse(errors.New("use POST")))
+			return
+		}
+		token := s.r.config.ControlToken
+		if len(token) == 0 {
+			writeJSON(w, http.StatusForbidden, errorResponse(errors.New("control requests need a control_token")))
+			return
+		}
+		auth := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, errorResponse(errors.New("invalid control token")))
+			return
+		}
 
-	pos := s.r.canal.SyncedPosition()
+		s.cl.RLock()
+		defer s.cl.RUnlock()
+		if s.closing {
+			writeJSON(w, http.StatusServiceUnavailable, errorResponse(errors.New("closing")))
+			return
+		}
+		h(w, r)
+	}
+}
 
-	buf.WriteString(fmt.Sprintf("server_current_binlog:(%s, %d)\n", binName, binPos))
-	buf.WriteString(fmt.Sprintf("read_binlog:%s\n", pos))
+// Starts a resnapshot of the table
+func (s *stat) serveResnapshot(w http.ResponseWriter, r *http.Request) {
+	schema, table := r.FormValue("schema"), r.FormValue("table")
+	if len(schema) == 0 || len(table) == 0 {
+		writeJSON(w, http.StatusBadRequest, errorResponse(errors.New("schema and table are required")))
+		return
+	}
+	if err := s.r.Resnapshot(schema, table); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"resnapshot": schema + "." + table})
+}
 
-	buf.WriteString(fmt.Sprintf("insert_num:%d\n", s.InsertNum.Get()))
-	buf.WriteString(fmt.Sprintf("update_num:%d\n", s.UpdateNum.Get()))
-	buf.WriteString(fmt.Sprintf("delete_num:%d\n", s.DeleteNum.Get()))
+// Starts a reindex of the index, which runs after the response
+func (s *stat) serveReindex(w http.ResponseWriter, r *http.Request) {
+	index := r.FormValue("index")
+	if len(index) == 0 {
+		writeJSON(w, http.StatusBadRequest, errorResponse(errors.New("index is required")))
+		return
+	}
+	if _, _, err := s.r.versionedRules(index); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	s.r.wg.Add(1)
+	go func() {
+		defer s.r.wg.Done()
+		if err := s.r.Reindex(index); err != nil {
+			log.Errorf("Reindex of %s failed: %v", index, err)
+		}
+	}()
+	writeJSON(w, http.StatusAccepted, map[string]string{"reindex": index})
+}
 
-	w.Write(buf.Bytes())
+// Serves the metrics in the Prometheus text format
+func (s *stat) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	s.collectLag()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := metrics.write(w); err != nil {
+		log.Warnf("Failed to write metrics: %v", err)
+	}
+}
+
+// Updates the lag metrics, which are measured when scraped
+func (s *stat) collectLag() {
+	now := time.Now()
+	secondsBehindSource.set(s.r.lag.secondsBehind(now))
+	if hb := s.r.lag.heartbeatStatus(now); hb != nil {
+		heartbeatFreshness.set(hb.FreshnessSeconds)
+	}
+
+	synced := s.r.canal.SyncedPosition()
+	if len(synced.Name) == 0 {
+		// still dumping
+		return
+	}
+	lag, err := s.r.canal.BinlogLag(synced)
+	if err != nil {
+		log.Warnf("Failed to measure binlog lag: %v", err)
+		return
+	}
+	binlogLagBytes.set(float64(lag))
+
+	if lag, err = s.r.canal.BinlogLag(s.r.canal.SafePosition().Position); err != nil {
+		log.Warnf("Failed to measure binlog lag: %v", err)
+	} else if t := s.r.canal.LastEventTime(); lag == 0 || t.IsZero() {
+		binlogLagSeconds.set(0)
+	} else {
+		binlogLagSeconds.set(time.Since(t).Seconds())
+	}
+}
+
+func errorResponse(err error) map[string]string {
+	return map[string]string{"error": err.Error()}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		code = http.StatusInternalServerError
+		data, _ = json.Marshal(errorResponse(err))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+	w.Write([]byte("\n"))
 }
 
 func (s *stat) Run(addr string) {
@@ -50,23 +278,38 @@ func (s *stat) Run(addr string) {
 		return
 	}
 	log.Infof("run status http server %s", addr)
-	var err error
-	s.l, err = net.Listen("tcp", addr)
+	s.cl.Lock()
+	if s.closing {
+		s.cl.Unlock()
+		return
+	}
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
+		s.cl.Unlock()
 		log.Errorf("listen stat addr %s err %v", addr, err)
 		return
 	}
 
-	srv := http.Server{}
 	mux := http.NewServeMux()
 	mux.Handle("/stat", s)
-	srv.Handler = mux
+	mux.HandleFunc("/resnapshot", s.serveControl(s.serveResnapshot))
+	mux.HandleFunc("/reindex", s.serveControl(s.serveReindex))
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	s.srv = &http.Server{Handler: mux}
+	srv := s.srv
+	s.cl.Unlock()
 
-	srv.Serve(s.l)
+	srv.Serve(l)
 }
 
+// Stops serving once any control requests being served have started what they
+// asked for
 func (s *stat) Close() {
-	if s.l != nil {
-		s.l.Close()
+	s.cl.Lock()
+	s.closing = true
+	srv := s.srv
+	s.cl.Unlock()
+	if srv != nil {
+		srv.Close()
 	}
 }
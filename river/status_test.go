@@ -0,0 +1,59 @@
+package river
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ehalpern/mysql2es/config"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+func TestStatCounts(t *testing.T) {
+	s := newStat(nil)
+	s.add("test", "t1", []elastic.BulkableRequest{
+		insertAction("idx", "t1", "1"),
+		insertAction("idx", "t1", "2"),
+		elastic.NewBulkDeleteRequest().Index("idx").Type("t1").Id("1"),
+	})
+	s.add("test", "t2", []elastic.BulkableRequest{
+		elastic.NewBulkUpdateRequest().Index("idx").Type("t2").Id("1").Doc(map[string]interface{}{}),
+	})
+
+	assert.Equal(t, int64(2), s.InsertNum.Get())
+	assert.Equal(t, int64(1), s.UpdateNum.Get())
+	assert.Equal(t, int64(1), s.DeleteNum.Get())
+	assert.Equal(t, BulkerStats{InsertCount: 2, DeleteCount: 1, Total: 3}, *s.rules["test.t1"])
+	assert.Equal(t, BulkerStats{UpdateCount: 1, Total: 1}, *s.rules["test.t2"])
+}
+
+func TestStatControlRequests(t *testing.T) {
+	cfg := config.Default
+	cfg.ControlToken = "secret"
+	s := newStat(&River{config: &cfg})
+	request := func(method string, url string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, nil)
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		s.serveControl(s.serveReindex)(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusMethodNotAllowed, request("GET", "/reindex?index=idx", "secret").Code)
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "/reindex?index=idx", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "/reindex?index=idx", "wrong").Code)
+	w := request("POST", "/reindex", "secret")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"error": "index is required"}`, w.Body.String())
+
+	// refused once closing
+	s.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, request("POST", "/reindex", "secret").Code)
+
+	// and without a token
+	cfg.ControlToken = ""
+	assert.Equal(t, http.StatusForbidden, request("POST", "/reindex", "").Code)
+}
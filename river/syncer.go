@@ -1,31 +1,165 @@
 package river
 
 import (
+	"sync"
+	"time"
+
 	"github.com/juju/errors"
 	"github.com/ehalpern/go-mysql/canal"
 	"github.com/siddontang/go/log"
 	"github.com/ehalpern/mysql2es/config"
+	"gopkg.in/olivere/elastic.v3"
 )
 
 type syncer struct {
+	river  *River
 	rules  *config.Runtime
 	bulker *Bulker
+	canal  positions
+
+	// where replication could resume from once each Add is acknowledged, for
+	// those not yet acknowledged, oldest first
+	m     sync.Mutex
+	marks []syncMark
+	acked uint64
+}
+
+// Where replication is and has been acknowledged up to, the river's canal
+type positions interface {
+	SafePosition() canal.SyncPosition
+	Checkpoint(pos canal.SyncPosition) error
+}
+
+type syncMark struct {
+	seq uint64
+	pos canal.SyncPosition
+}
+
+func newSyncer(r *River, bulker *Bulker) *syncer {
+	s := &syncer{river: r, rules: r.rules, bulker: bulker, canal: r.canal}
+	// Only advance the replication position once elasticsearch has acknowledged
+	// the rows read before it.
+	bulker.OnAcknowledged = s.checkpoint
+	return s
 }
 
 func (s *syncer) Do(e *canal.RowsEvent) error {
+	if s.river.isHeartbeat(e) {
+		return s.doHeartbeat(e)
+	}
 	if !s.ignoreEvent(e) {
-		actions, err := Convert(s.rules, e)
-		if err == nil {
-			err = s.bulker.Add(actions)
+		eventsTotal.add(1, e.Table.Schema, e.Table.Name, e.Action)
+		var err error
+		first := 0
+		for _, rows := range rowGroups(e) {
+			re := *e
+			re.Rows = rows
+			var actions []elastic.BulkableRequest
+			if actions, err = s.convert(&re, first); err != nil {
+				break
+			}
+			first += len(rows)
+			s.river.st.add(e.Table.Schema, e.Table.Name, actions)
+			if err = s.bulker.AddFrom(newActionSource(e, rows), actions); err != nil {
+				break
+			}
 		}
 		if err != nil {
 			log.Errorf("Handler failing due to %v", err)
 			return canal.ErrHandleInterrupted
 		}
+		seq := s.bulker.Added()
+		if e.Timestamp > 0 {
+			s.river.lag.added(seq, e.Timestamp)
+		}
+		s.mark(seq)
 	}
 	return nil
 }
 
+// Records that replication can resume from the safe position once Add number seq,
+// the last made for the rows read before it, is acknowledged
+func (s *syncer) mark(seq uint64) {
+	pos := s.canal.SafePosition()
+	s.m.Lock()
+	defer s.m.Unlock()
+	if seq <= s.acked {
+		// the rows are already in Elasticsearch, but not safe to resume after until
+		// the next checkpoint
+		return
+	} else if n := len(s.marks); n > 0 && s.marks[n-1].seq == seq {
+		s.marks[n-1].pos = pos
+	} else {
+		s.marks = append(s.marks, syncMark{seq, pos})
+	}
+}
+
+// Splits the event's rows into those converted together, each row or, for
+// updates, each before and after image, so every action is traced to its row
+func rowGroups(e *canal.RowsEvent) [][][]interface{} {
+	n := 1
+	if e.Action == canal.UpdateAction {
+		n = 2
+	}
+	var groups [][][]interface{}
+	for i := 0; i < len(e.Rows); i += n {
+		end := i + n
+		if end > len(e.Rows) {
+			end = len(e.Rows)
+		}
+		groups = append(groups, e.Rows[i:end])
+	}
+	return groups
+}
+
+// Converts the event for the rule's index, and for the new version of the index
+// too while it's being reindexed. Snapshot rows only go to the new version, which
+// they were read for. The rows start at row first of the binlog event.
+func (s *syncer) convert(e *canal.RowsEvent, first int) ([]elastic.BulkableRequest, error) {
+	rule := s.rules.GetRule(e.Table.Schema, e.Table.Name)
+	if rule == nil {
+		return nil, errors.Errorf("no rule found for %s.%s", e.Table.Schema, e.Table.Name)
+	}
+	next := s.river.reindexTarget(rule.Index)
+	if len(next) == 0 {
+		return convertEvent(rule, e, first)
+	}
+	reqs, err := convertReindex(rule, next, e, first)
+	if err != nil || e.Snapshot {
+		return reqs, err
+	}
+	current, err := convertEvent(rule, e, first)
+	return append(current, reqs...), err
+}
+
+// Syncs the river's heartbeats into Elasticsearch like any other row, noting when
+// they were written so the round trip is measured once they are acknowledged
+func (s *syncer) doHeartbeat(e *canal.RowsEvent) error {
+	if e.Snapshot {
+		return nil
+	}
+	// before adding, since it may be acknowledged before Add returns
+	seq := s.bulker.Added() + 1
+	for _, written := range heartbeatTimes(s.river.heartbeat, s.river.config.DbSlaveID, e) {
+		s.river.lag.addedHeartbeat(seq, written)
+	}
+	actions, err := convertEvent(s.river.heartbeat, e, 0)
+	if err == nil {
+		err = s.bulker.Add(actions)
+	}
+	if err == nil {
+		// rather than waiting for full batches, which also bounds how long the
+		// changes before it wait
+		err = s.bulker.Flush()
+	}
+	if err != nil {
+		log.Errorf("Handler failing on heartbeat due to %v", err)
+		return canal.ErrHandleInterrupted
+	}
+	s.mark(seq)
+	return nil
+}
+
 func (s *syncer) ignoreEvent(e *canal.RowsEvent) bool {
 	ignore := s.rules.GetRule(e.Table.Schema, e.Table.Name) == nil
 	if ignore {
@@ -34,6 +168,26 @@ func (s *syncer) ignoreEvent(e *canal.RowsEvent) bool {
 	return ignore
 }
 
+// Advances the replication position past the rows whose actions were made in Add
+// number seq and before
+func (s *syncer) checkpoint(seq uint64) {
+	s.river.lag.acknowledged(seq, time.Now())
+	s.m.Lock()
+	s.acked = seq
+	var pos *canal.SyncPosition
+	for len(s.marks) > 0 && s.marks[0].seq <= seq {
+		pos = &s.marks[0].pos
+		s.marks = s.marks[1:]
+	}
+	s.m.Unlock()
+	if pos == nil {
+		return
+	}
+	if err := s.canal.Checkpoint(*pos); err != nil {
+		log.Errorf("Failed to checkpoint replication position: %v", err)
+	}
+}
+
 func (s *syncer) Complete() error {
 	err := s.bulker.Submit()
 	if err != nil {
@@ -0,0 +1,153 @@
+package river
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ehalpern/go-mysql/canal"
+	"github.com/ehalpern/go-mysql/dump"
+	"github.com/ehalpern/go-mysql/mysql"
+	"github.com/ehalpern/go-mysql/schema"
+	"github.com/ehalpern/mysql2es/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Fakes the canal's positions, recording every checkpoint
+type fakePositions struct {
+	m     sync.Mutex
+	safe  canal.SyncPosition
+	saved []canal.SyncPosition
+}
+
+func (p *fakePositions) SafePosition() canal.SyncPosition {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.safe
+}
+
+func (p *fakePositions) Checkpoint(pos canal.SyncPosition) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.saved = append(p.saved, pos)
+	return nil
+}
+
+func (p *fakePositions) setSafe(name string, pos uint32) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.safe = canal.SyncPosition{Position: mysql.Position{Name: name, Pos: pos}}
+}
+
+// While dumping, with the progress of t1 after rows
+func (p *fakePositions) setDumped(rows uint64) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.safe = canal.SyncPosition{Dump: map[string]dump.TableProgress{"test.t1": {Rows: rows}}}
+}
+
+func (p *fakePositions) checkpoints() []canal.SyncPosition {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return append([]canal.SyncPosition(nil), p.saved...)
+}
+
+func newTestSyncer(t *testing.T, s *fakeBulkServer, maxActions int) (*syncer, *fakePositions) {
+	rule := config.NewDefaultRule("test", "t1")
+	rule.TableInfo = &schema.Table{Schema: "test", Name: "t1"}
+	rule.TableInfo.AddColumn("id", "int(11)", "")
+	rule.TableInfo.AddColumn("title", "varchar(256)", "")
+	rule.TableInfo.AddIndexWithColumns("PRIMARY", "id")
+
+	r := &River{config: &config.Default, reindexing: make(map[string]string)}
+	r.st = newStat(r)
+	r.rules = &config.Runtime{Rules: map[string]*config.Rule{"test:t1": rule}}
+	b := newFakeBulker(t, s)
+	b.MaxActions = maxActions
+	sy := newSyncer(r, b)
+	p := &fakePositions{}
+	sy.canal = p
+	return sy, p
+}
+
+// A row of t1 read from the binlog at pos
+func insertEvent(sy *syncer, id int64, pos uint32) *canal.RowsEvent {
+	table := sy.rules.GetRule("test", "t1").TableInfo
+	return &canal.RowsEvent{Table: table, Action: canal.InsertAction, Rows: [][]interface{}{{id, "title"}},
+		Position: mysql.Position{Name: "mysql-bin.000001", Pos: pos}}
+}
+
+func TestSyncerFailedSubmit(t *testing.T) {
+	s := newFakeBulkServer([]int{http.StatusServiceUnavailable}, []int{http.StatusServiceUnavailable})
+	defer s.Close()
+	sy, p := newTestSyncer(t, s, 10)
+	defer sy.bulker.Close()
+	sy.bulker.MaxRetries = 1
+
+	p.setSafe("mysql-bin.000001", 100)
+	require.Nil(t, sy.Do(insertEvent(sy, 1, 150)))
+	// the transaction commits
+	p.setSafe("mysql-bin.000001", 200)
+	assert.NotNil(t, sy.Complete())
+	assert.Empty(t, p.checkpoints())
+}
+
+func TestSyncerMidTransactionFlush(t *testing.T) {
+	s := newFakeBulkServer()
+	defer s.Close()
+	// held until both rows are added, so the flush is acknowledged after both are
+	s.release = make(chan struct{})
+	sy, p := newTestSyncer(t, s, 2)
+	defer sy.bulker.Close()
+
+	// the second row of the transaction fills the batch, flushing it before the
+	// transaction commits
+	p.setSafe("mysql-bin.000001", 100)
+	require.Nil(t, sy.Do(insertEvent(sy, 1, 150)))
+	require.Nil(t, sy.Do(insertEvent(sy, 2, 180)))
+	close(s.release)
+	// acknowledged without submitting
+	for i := 0; i < 100 && len(p.checkpoints()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, s.requests())
+	// only as far as the transaction before
+	assert.Equal(t, []canal.SyncPosition{{Position: mysql.Position{Name: "mysql-bin.000001", Pos: 100}}},
+		p.checkpoints())
+
+	// the commit, and the next transaction
+	p.setSafe("mysql-bin.000001", 200)
+	require.Nil(t, sy.Do(insertEvent(sy, 3, 250)))
+	require.Nil(t, sy.Complete())
+	saved := p.checkpoints()
+	require.Len(t, saved, 2)
+	assert.Equal(t, uint32(200), saved[1].Pos)
+}
+
+func TestSyncerDumpProgress(t *testing.T) {
+	s := newFakeBulkServer()
+	defer s.Close()
+	s.release = make(chan struct{})
+	// each row is flushed on its own
+	sy, p := newTestSyncer(t, s, 1)
+	defer sy.bulker.Close()
+
+	// rows handed to the syncer, each followed by the chunk it ends
+	for i := 1; i <= 3; i++ {
+		require.Nil(t, sy.Do(insertEvent(sy, int64(i), 0)))
+		p.setDumped(uint64(i))
+	}
+	// the first two are acknowledged while the third is pending
+	s.release <- struct{}{}
+	s.release <- struct{}{}
+	for i := 0; i < 100 && len(p.checkpoints()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	saved := p.checkpoints()
+	require.Len(t, saved, 2)
+	// as of the chunk ended before the second row was handed over
+	assert.Equal(t, map[string]dump.TableProgress{"test.t1": {Rows: 1}}, saved[1].Dump)
+	close(s.release)
+}
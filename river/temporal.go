@@ -0,0 +1,111 @@
+package river
+
+import (
+	"strings"
+	"time"
+
+	"github.com/ehalpern/go-mysql/schema"
+	"github.com/ehalpern/mysql2es/config"
+	"github.com/siddontang/go/log"
+)
+
+const (
+	dateLayout = "2006-01-02"
+	// parses values with or without fractional seconds
+	datetimeLayout = "2006-01-02 15:04:05.999999999"
+)
+
+// Converts a DATETIME, TIMESTAMP, DATE or TIME value to ISO-8601. Datetimes and
+// timestamps are sent in UTC, e.g. 2006-01-02T15:04:05.000Z, dates as 2006-01-02
+// and times as 15:04:05.000. Datetimes are read in the configured zone and
+// timestamps in UTC.
+func convertTemporal(tc *config.TimeConversion, col *schema.TableColumn, value interface{}) interface{} {
+	if tc == nil {
+		tc = config.DefaultTimeConversion
+	}
+	digits := col.Decimals
+	if tc.Precision >= 0 {
+		digits = tc.Precision
+	}
+
+	var s string
+	switch value := value.(type) {
+	case string:
+		s = value
+	case []byte:
+		s = string(value)
+	case time.Time:
+		return formatDatetime(value, digits)
+	default:
+		return value
+	}
+
+	switch col.Type {
+	case schema.TYPE_TIME:
+		return truncateFraction(s, digits)
+	case schema.TYPE_DATE:
+		if isZeroDate(s) {
+			return zeroDate(tc, s, dateLayout)
+		} else if _, err := time.Parse(dateLayout, s); err != nil {
+			log.Warnf("Sending invalid date '%s' of column %s as is: %v", s, col.Name, err)
+		}
+		return s
+	default:
+		if isZeroDate(s) {
+			return zeroDate(tc, s, datetimeFormat(digits))
+		}
+		loc := tc.Location
+		if col.Type == schema.TYPE_TIMESTAMP {
+			loc = time.UTC
+		}
+		t, err := time.ParseInLocation(datetimeLayout, s, loc)
+		if err != nil {
+			log.Warnf("Sending invalid datetime '%s' of column %s as is: %v", s, col.Name, err)
+			return s
+		}
+		return formatDatetime(t, digits)
+	}
+}
+
+// Returns whether the year, month or day of a date or datetime is zero, which
+// MySQL allows but ISO-8601 doesn't
+func isZeroDate(s string) bool {
+	return len(s) >= len(dateLayout) && (s[:4] == "0000" || s[5:7] == "00" || s[8:10] == "00")
+}
+
+// Returns what the zero date s becomes, formatting the epoch with layout
+func zeroDate(tc *config.TimeConversion, s string, layout string) interface{} {
+	switch tc.ZeroDate {
+	case config.ZeroDateKeep:
+		return s
+	case config.ZeroDateEpoch:
+		return time.Unix(0, 0).UTC().Format(layout)
+	default:
+		return nil
+	}
+}
+
+func datetimeFormat(digits int) string {
+	layout := "2006-01-02T15:04:05"
+	if digits > 0 {
+		layout += "." + strings.Repeat("0", digits)
+	}
+	return layout + "Z"
+}
+
+// Formats t in UTC with digits fractional second digits, truncated
+func formatDatetime(t time.Time, digits int) string {
+	return t.UTC().Format(datetimeFormat(digits))
+}
+
+// Returns the time s with exactly digits fractional second digits
+func truncateFraction(s string, digits int) string {
+	frac := ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		s, frac = s[:i], s[i+1:]
+	}
+	if digits == 0 {
+		return s
+	}
+	return s + "." + (frac + strings.Repeat("0", digits))[:digits]
+}
@@ -0,0 +1,53 @@
+package river
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/ehalpern/mysql2es/config"
+	"github.com/juju/errors"
+)
+
+// Returns a TLS config trusting the CAs in the PEM bundle caCert rather than the
+// system's, if given, and presenting the client certificate, if given. Errors name
+// the options by their prefix, like "es_".
+func newTLSConfig(prefix string, caCert string, clientCert string, clientKey string, insecure bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if len(caCert) > 0 {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, errors.Annotatef(err, "reading %sca_cert", prefix)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %sca_cert %s", prefix, caCert)
+		}
+	}
+	if len(clientCert) > 0 || len(clientKey) > 0 {
+		if len(clientCert) == 0 || len(clientKey) == 0 {
+			return nil, errors.Errorf("%sclient_cert and %sclient_key must be given together", prefix, prefix)
+		}
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, errors.Annotatef(err, "loading %sclient_cert", prefix)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Returns the TLS config of connections to MySQL, or nil if db_tls isn't set. The
+// server's name is verified against db_tls_server_name, or the host of db_host.
+func dbTLSConfig(c *config.Config) (*tls.Config, error) {
+	if !c.DbTLS {
+		return nil, nil
+	}
+	tlsConfig, err := newTLSConfig("db_tls_", c.DbTLSCaCert, c.DbTLSClientCert, c.DbTLSClientKey,
+		c.DbTLSInsecureSkipVerify)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	tlsConfig.ServerName = c.DbTLSServerName
+	return tlsConfig, nil
+}
@@ -0,0 +1,43 @@
+package river
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehalpern/mysql2es/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDbTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := newFakeTLSServer()
+	defer s.Close()
+
+	c := config.Default
+	tlsConfig, err := dbTLSConfig(&c)
+	assert.Nil(t, err)
+	assert.Nil(t, tlsConfig)
+
+	c.DbTLS = true
+	c.DbTLSCaCert = writeCACert(t, s, dir)
+	c.DbTLSServerName = "db.test.com"
+	tlsConfig, err = dbTLSConfig(&c)
+	require.Nil(t, err)
+	assert.NotNil(t, tlsConfig.RootCAs)
+	assert.Equal(t, "db.test.com", tlsConfig.ServerName)
+	assert.False(t, tlsConfig.InsecureSkipVerify)
+
+	c.DbTLSCaCert = filepath.Join(dir, "missing.pem")
+	_, err = dbTLSConfig(&c)
+	assert.NotNil(t, err)
+
+	c.DbTLSCaCert = ""
+	c.DbTLSClientKey = filepath.Join(dir, "client.key")
+	_, err = dbTLSConfig(&c)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,227 @@
+package river
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ehalpern/mysql2es/config"
+	"github.com/juju/errors"
+	"github.com/siddontang/go/log"
+)
+
+// A versioned index is an alias of its current version, the physical index
+// <index>-N. Reindex fills version N+1 from a resnapshot of the tables synced
+// into the index while binlog changes are written to both versions, then switches
+// the alias to it.
+
+func versionedIndex(index string, version int) string {
+	return fmt.Sprintf("%s-%d", index, version)
+}
+
+// Returns the version of the index that name is, or 0 if it isn't one
+func indexVersion(index string, name string) int {
+	if !strings.HasPrefix(name, index+"-") {
+		return 0
+	}
+	v, err := strconv.Atoi(name[len(index)+1:])
+	if err != nil || v <= 0 || versionedIndex(index, v) != name {
+		return 0
+	}
+	return v
+}
+
+// Returns the versions of the index among the index names, oldest first
+func indexVersions(index string, names []string) []int {
+	var versions []int
+	for _, name := range names {
+		if v := indexVersion(index, name); v > 0 {
+			versions = append(versions, v)
+		}
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// Returns the versions to delete so only the newest keep versions remain. The
+// current version is never deleted.
+func prunedVersions(versions []int, current int, keep int) []int {
+	var pruned []int
+	for i, v := range versions {
+		if len(versions)-i > keep && v != current {
+			pruned = append(pruned, v)
+		}
+	}
+	return pruned
+}
+
+// Returns the physical index the alias points to, or "" if there is no alias,
+// and the versions of the index that exist
+func (r *River) aliasVersions(index string) (string, []int, error) {
+	res, err := r.es.Aliases().Do()
+	if err != nil {
+		return "", nil, errors.Trace(err)
+	}
+	current := ""
+	if indexes := res.IndicesByAlias(index); len(indexes) > 1 {
+		return "", nil, errors.Errorf("alias %s points to several indexes %v", index, indexes)
+	} else if len(indexes) == 1 {
+		current = indexes[0]
+	}
+	names := make([]string, 0, len(res.Indices))
+	for name := range res.Indices {
+		names = append(names, name)
+	}
+	return current, indexVersions(index, names), nil
+}
+
+// Creates a version of the index following the existing ones
+func (r *River) createVersion(index string, versions []int, settings map[string]interface{}) (string, error) {
+	v := 1
+	if len(versions) > 0 {
+		v = versions[len(versions)-1] + 1
+	}
+	name := versionedIndex(index, v)
+	log.Infof("Creating version %s of index %s with settings %v", name, index, settings)
+	create := r.es.CreateIndex(name)
+	if settings != nil {
+		create.BodyJson(settings)
+	}
+	if _, err := create.Do(); err != nil {
+		return "", errors.Annotatef(err, "creating %s", name)
+	}
+	return name, nil
+}
+
+// Creates the first version of a versioned index and its alias, unless the alias
+// exists
+func (r *River) createVersionedIndex(index string, settings map[string]interface{}) error {
+	current, versions, err := r.aliasVersions(index)
+	if err != nil {
+		return err
+	} else if len(current) > 0 {
+		return nil
+	}
+	if exists, err := r.es.IndexExists(index).Do(); err != nil {
+		return errors.Trace(err)
+	} else if exists {
+		return errors.Errorf("index %s already exists, so it can't be the alias of a versioned index", index)
+	}
+	name, err := r.createVersion(index, versions, settings)
+	if err != nil {
+		return err
+	}
+	_, err = r.es.Alias().Add(name, index).Do()
+	return errors.Trace(err)
+}
+
+// Returns the version of the index being filled by Reindex, or "" if none
+func (r *River) reindexTarget(index string) string {
+	r.rl.Lock()
+	defer r.rl.Unlock()
+	return r.reindexing[index]
+}
+
+func (r *River) setReindexTarget(index string, name string) error {
+	r.rl.Lock()
+	defer r.rl.Unlock()
+	if len(name) == 0 {
+		delete(r.reindexing, index)
+	} else if next, ok := r.reindexing[index]; ok {
+		return errors.Errorf("%s is already being reindexed into %s", index, next)
+	} else {
+		r.reindexing[index] = name
+	}
+	return nil
+}
+
+// Returns the rules of a versioned index and the number of versions to keep
+func (r *River) versionedRules(index string) ([]*config.Rule, int, error) {
+	rules := r.rules.IndexRules(index)
+	if len(rules) == 0 {
+		return nil, 0, errors.Errorf("no table is synced into %s", index)
+	}
+	keep := 0
+	for _, rule := range rules {
+		if rule.Versions == 0 {
+			return nil, 0, errors.Errorf("%s isn't versioned; set versions in the rule of %s.%s", index, rule.Schema, rule.Table)
+		} else if rule.Versions > keep {
+			keep = rule.Versions
+		}
+	}
+	return rules, keep, nil
+}
+
+// Reindex fills a new version of a versioned index from a resnapshot of every
+// table synced into it, e.g. after changing its settings or mappings, then
+// switches the alias to the new version and deletes versions beyond those kept.
+// The alias keeps serving the current version meanwhile. Returns once the alias
+// has been switched.
+func (r *River) Reindex(index string) error {
+	rules, keep, err := r.versionedRules(index)
+	if err != nil {
+		return err
+	}
+	if err := r.createRuleIndex(rules[0]); err != nil {
+		return err
+	}
+	settings, err := r.indexSettings(rules[0])
+	if err != nil {
+		return err
+	}
+	current, versions, err := r.aliasVersions(index)
+	if err != nil {
+		return err
+	}
+	next, err := r.createVersion(index, versions, settings)
+	if err != nil {
+		return err
+	}
+	if err = r.setReindexTarget(index, next); err == nil {
+		err = r.fillVersion(next, rules)
+		if err == nil {
+			log.Infof("Switching alias %s from %s to %s", index, current, next)
+			_, err = r.es.Alias().Remove(current, index).Add(next, index).Do()
+		}
+		r.setReindexTarget(index, "")
+	}
+	if err != nil {
+		log.Errorf("Reindex of %s into %s failed, deleting it: %v", index, next, err)
+		if _, derr := r.es.DeleteIndex(next).Do(); derr != nil {
+			log.Errorf("Failed to delete %s: %v", next, derr)
+		}
+		return errors.Trace(err)
+	}
+
+	versions = append(versions, indexVersion(index, next))
+	for _, v := range prunedVersions(versions, indexVersion(index, next), keep) {
+		name := versionedIndex(index, v)
+		log.Infof("Deleting old version %s of index %s", name, index)
+		if _, err := r.es.DeleteIndex(name).Do(); err != nil {
+			return errors.Annotatef(err, "deleting %s", name)
+		}
+	}
+	return nil
+}
+
+// Resnapshots the rules' tables one at a time while their rows are written to the
+// new version
+func (r *River) fillVersion(name string, rules []*config.Rule) error {
+	for _, rule := range rules {
+		log.Infof("Reindexing %s.%s into %s", rule.Schema, rule.Table, name)
+		done, err := r.canal.Resnapshot(rule.Schema, rule.Table)
+		if err != nil {
+			return err
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+		case <-r.quit:
+			return errors.New("river closed")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package river
+
+import (
+	"testing"
+
+	"github.com/ehalpern/go-mysql/canal"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+func TestIndexVersions(t *testing.T) {
+	names := []string{"river-10", "river", "river-2", "river-x", "river-02", "river-logs-1", "other-3", "river-1"}
+	assert.Equal(t, []int{1, 2, 10}, indexVersions("river", names))
+	assert.Equal(t, 1, indexVersion("river-logs", "river-logs-1"))
+	assert.Equal(t, 0, indexVersion("river", "river-0"))
+
+	assert.Equal(t, []int{1, 2}, prunedVersions([]int{1, 2, 3, 4}, 4, 2))
+	assert.Empty(t, prunedVersions([]int{3, 4}, 4, 2))
+	// the version in use is kept whatever its age
+	assert.Equal(t, []int{2}, prunedVersions([]int{1, 2, 3}, 1, 1))
+}
+
+func TestConvertReindex(t *testing.T) {
+	rule := compositeRule()
+	rule.Index = "composite"
+	e := &canal.RowsEvent{Table: rule.TableInfo, Action: canal.UpdateAction, Rows: [][]interface{}{
+		{int64(1), int64(2), "before"},
+		{int64(1), int64(2), "after"},
+	}}
+
+	// the new version may not have the document yet, so it's replaced whole
+	reqs, err := convertReindex(rule, "composite-2", e, 0)
+	assert.Nil(t, err)
+	assert.Len(t, reqs, 1)
+	index, ok := reqs[0].(*elastic.BulkIndexRequest)
+	assert.True(t, ok)
+	assert.Contains(t, index.String(), `"_index":"composite-2"`)
+	assert.Contains(t, index.String(), `"title":"after"`)
+	assert.Equal(t, "composite", rule.Index)
+
+	e.Rows[1] = []interface{}{int64(3), int64(2), "after"}
+	reqs, err = convertReindex(rule, "composite-2", e, 0)
+	assert.Nil(t, err)
+	assert.Len(t, reqs, 2)
+	del, ok := reqs[0].(*elastic.BulkDeleteRequest)
+	assert.True(t, ok)
+	assert.Contains(t, del.String(), `"_id":"1:2"`)
+}